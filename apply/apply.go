@@ -0,0 +1,427 @@
+// Package apply creates Kubernetes objects or brings existing ones in to line
+// with what's wanted, a bit like 'kubectl apply', so a launcher can be run
+// again without failing on objects it made last time.
+//
+// Only the parts of an object a launcher cares about are applied: labels and
+// annotations, which are added to any already on the object, and deleted once
+// they're no longer wanted if they were applied before; for services, the
+// type, selector and ports, which are replaced; and for deployments, the
+// number of replicas and the pod template. The specs of pods and claims can't
+// be changed once they're created, so only their metadata is applied, though
+// a pod whose spec isn't the one wanted is reported as Outdated.
+//
+// Every launcher in the repository vendors this package with dep, so it's
+// built against the same Kubernetes types as the launcher using it.
+package apply
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Result says what applying an object did.
+type Result string
+
+const (
+	Created   Result = "created"
+	Updated   Result = "updated"
+	Unchanged Result = "unchanged"
+	// Outdated is an existing object whose spec isn't the one wanted, and
+	// can't be changed in place. It has to be deleted to be made again.
+	Outdated Result = "outdated"
+)
+
+// TemplateHashAnnotation is set on deployments to a hash of the pod template
+// they were last applied with, so the template is only patched, and the pods
+// replaced, when it changes.
+const TemplateHashAnnotation = "apply/template-hash"
+
+// SpecHashAnnotation is set on pods to a hash of the spec they were created
+// with, so a pod that's no longer what's wanted can be told apart.
+const SpecHashAnnotation = "apply/spec-hash"
+
+// LabelsAnnotation and AnnotationsAnnotation list, comma separated, the keys
+// of the labels and annotations last applied to an object, so that the ones
+// no longer wanted can be told apart from those added by someone else.
+const (
+	LabelsAnnotation      = "apply/labels"
+	AnnotationsAnnotation = "apply/annotations"
+)
+
+// Pod creates the pod if there isn't one by its name in its namespace, or
+// otherwise patches the existing pod's labels and annotations to match. If
+// the existing pod wasn't created with the wanted spec, it's left running
+// and reported as Outdated.
+func Pod(clientset kubernetes.Interface, pod *v1.Pod) (*v1.Pod, Result, error) {
+	hash, err := hashOf(&pod.Spec)
+	if err != nil {
+		return nil, "", err
+	}
+	pod = pod.DeepCopy()
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pod.ObjectMeta.Annotations[SpecHashAnnotation] = hash
+	recordApplied(&pod.ObjectMeta)
+
+	pods := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace)
+	existing, err := pods.Get(pod.ObjectMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		created, err := pods.Create(pod)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create pod %s: %v", pod.ObjectMeta.Name, err)
+		}
+		return created, Created, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get pod %s: %v", pod.ObjectMeta.Name, err)
+	}
+	result := Updated
+	if current := existing.ObjectMeta.Annotations[SpecHashAnnotation]; current != hash {
+		//The spec is still the old one, so the hash must be too
+		result = Outdated
+		if current == "" {
+			delete(pod.ObjectMeta.Annotations, SpecHashAnnotation)
+		} else {
+			pod.ObjectMeta.Annotations[SpecHashAnnotation] = current
+		}
+		recordApplied(&pod.ObjectMeta)
+	}
+	patch := metadataPatch(&existing.ObjectMeta, &pod.ObjectMeta)
+	if len(patch) == 0 {
+		if result == Outdated {
+			return existing, Outdated, nil
+		}
+		return existing, Unchanged, nil
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, "", err
+	}
+	patched, err := pods.Patch(pod.ObjectMeta.Name, types.MergePatchType, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update pod %s: %v", pod.ObjectMeta.Name, err)
+	}
+	return patched, result, nil
+}
+
+// Service creates the service if there isn't one by its name in its
+// namespace, or otherwise patches the existing service's labels, annotations,
+// type, selector and ports to match. Ports without a NodePort keep the one
+// they were given before, unless it is a ClusterIP service.
+func Service(clientset kubernetes.Interface, svc *v1.Service) (*v1.Service, Result, error) {
+	svc = svc.DeepCopy()
+	recordApplied(&svc.ObjectMeta)
+	services := clientset.CoreV1().Services(svc.ObjectMeta.Namespace)
+	existing, err := services.Get(svc.ObjectMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		created, err := services.Create(svc)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create service %s: %v", svc.ObjectMeta.Name, err)
+		}
+		return created, Created, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get service %s: %v", svc.ObjectMeta.Name, err)
+	}
+
+	patch := metadataPatch(&existing.ObjectMeta, &svc.ObjectMeta)
+	spec := make(map[string]interface{})
+	serviceType := svc.Spec.Type
+	if serviceType == "" {
+		serviceType = v1.ServiceTypeClusterIP
+	}
+	if serviceType != existing.Spec.Type {
+		spec["type"] = serviceType
+	}
+	if serviceType == v1.ServiceTypeClusterIP {
+		//Only allowed on services exposed outside the cluster
+		if existing.Spec.ExternalTrafficPolicy != "" {
+			spec["externalTrafficPolicy"] = nil
+		}
+		if existing.Spec.HealthCheckNodePort != 0 {
+			spec["healthCheckNodePort"] = nil
+		}
+	}
+	if !reflect.DeepEqual(svc.Spec.Selector, existing.Spec.Selector) && (len(svc.Spec.Selector) > 0 || len(existing.Spec.Selector) > 0) {
+		selector := make(map[string]interface{})
+		for key := range existing.Spec.Selector {
+			selector[key] = nil
+		}
+		for key, value := range svc.Spec.Selector {
+			selector[key] = value
+		}
+		spec["selector"] = selector
+	}
+	ports := desiredPorts(svc.Spec.Ports, existing.Spec.Ports, serviceType)
+	if !reflect.DeepEqual(ports, existing.Spec.Ports) {
+		spec["ports"] = ports
+	}
+	if len(spec) > 0 {
+		patch["spec"] = spec
+	}
+	if len(patch) == 0 {
+		return existing, Unchanged, nil
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, "", err
+	}
+	patched, err := services.Patch(svc.ObjectMeta.Name, types.MergePatchType, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update service %s: %v", svc.ObjectMeta.Name, err)
+	}
+	return patched, Updated, nil
+}
+
+// PersistentVolumeClaim creates the claim if there isn't one by its name in
+// its namespace, or otherwise patches the existing claim's labels and
+// annotations to match. The existing claim, and the data on it, is kept
+// however its spec differs.
+func PersistentVolumeClaim(clientset kubernetes.Interface, claim *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, Result, error) {
+	claim = claim.DeepCopy()
+	recordApplied(&claim.ObjectMeta)
+	claims := clientset.CoreV1().PersistentVolumeClaims(claim.ObjectMeta.Namespace)
+	existing, err := claims.Get(claim.ObjectMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		created, err := claims.Create(claim)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create claim %s: %v", claim.ObjectMeta.Name, err)
+		}
+		return created, Created, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get claim %s: %v", claim.ObjectMeta.Name, err)
+	}
+	patch := metadataPatch(&existing.ObjectMeta, &claim.ObjectMeta)
+	if len(patch) == 0 {
+		return existing, Unchanged, nil
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, "", err
+	}
+	patched, err := claims.Patch(claim.ObjectMeta.Name, types.MergePatchType, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update claim %s: %v", claim.ObjectMeta.Name, err)
+	}
+	return patched, Updated, nil
+}
+
+// Deployment creates the deployment if there isn't one by its name in its
+// namespace, or otherwise patches the existing deployment's labels,
+// annotations and replicas to match, and replaces its pod template if that
+// has changed since it was last applied. The selector can't be changed.
+func Deployment(clientset kubernetes.Interface, deployment *appsv1.Deployment) (*appsv1.Deployment, Result, error) {
+	hash, err := hashOf(&deployment.Spec.Template)
+	if err != nil {
+		return nil, "", err
+	}
+	deployment = deployment.DeepCopy()
+	if deployment.ObjectMeta.Annotations == nil {
+		deployment.ObjectMeta.Annotations = make(map[string]string)
+	}
+	deployment.ObjectMeta.Annotations[TemplateHashAnnotation] = hash
+	recordApplied(&deployment.ObjectMeta)
+
+	deployments := clientset.AppsV1().Deployments(deployment.ObjectMeta.Namespace)
+	existing, err := deployments.Get(deployment.ObjectMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		created, err := deployments.Create(deployment)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create deployment %s: %v", deployment.ObjectMeta.Name, err)
+		}
+		return created, Created, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get deployment %s: %v", deployment.ObjectMeta.Name, err)
+	}
+
+	patch := metadataPatch(&existing.ObjectMeta, &deployment.ObjectMeta)
+	spec := make(map[string]interface{})
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if existing.Spec.Replicas == nil || *existing.Spec.Replicas != replicas {
+		spec["replicas"] = replicas
+	}
+	if existing.ObjectMeta.Annotations[TemplateHashAnnotation] != hash {
+		//A merge patch only sets what's in it, so whatever the old template
+		//has that the new one doesn't, such as an init container, is nulled
+		template, err := diffPatch(&existing.Spec.Template, &deployment.Spec.Template)
+		if err != nil {
+			return nil, "", err
+		}
+		spec["template"] = template
+	}
+	if len(spec) > 0 {
+		patch["spec"] = spec
+	}
+	if len(patch) == 0 {
+		return existing, Unchanged, nil
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, "", err
+	}
+	patched, err := deployments.Patch(deployment.ObjectMeta.Name, types.MergePatchType, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to update deployment %s: %v", deployment.ObjectMeta.Name, err)
+	}
+	return patched, Updated, nil
+}
+
+// hashOf returns a hash of part of an object, such as a pod template.
+func hashOf(obj interface{}) (string, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// recordApplied sets the LabelsAnnotation and AnnotationsAnnotation of the
+// wanted metadata to the keys of its labels and annotations.
+func recordApplied(meta *metav1.ObjectMeta) {
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	delete(meta.Annotations, LabelsAnnotation)
+	delete(meta.Annotations, AnnotationsAnnotation)
+	annotations := joinKeys(meta.Annotations)
+	meta.Annotations[LabelsAnnotation] = joinKeys(meta.Labels)
+	meta.Annotations[AnnotationsAnnotation] = annotations
+}
+
+// joinKeys returns the keys of m, sorted and comma separated.
+func joinKeys(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// metadataPatch returns a JSON merge patch, as a map, adding the wanted labels
+// and annotations to the existing ones and deleting those applied last time
+// that are no longer wanted, or an empty map if there's nothing to change.
+func metadataPatch(existing, wanted *metav1.ObjectMeta) map[string]interface{} {
+	patch := make(map[string]interface{})
+	metadata := make(map[string]interface{})
+	if changed := changes(existing.Labels, wanted.Labels, existing.Annotations[LabelsAnnotation]); len(changed) > 0 {
+		metadata["labels"] = changed
+	}
+	if changed := changes(existing.Annotations, wanted.Annotations, existing.Annotations[AnnotationsAnnotation]); len(changed) > 0 {
+		metadata["annotations"] = changed
+	}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	return patch
+}
+
+// changes returns the entries of wanted that aren't in existing, and nulls
+// for the existing entries with the applied keys that aren't wanted.
+func changes(existing, wanted map[string]string, applied string) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for key, value := range wanted {
+		if current, ok := existing[key]; !ok || current != value {
+			changed[key] = value
+		}
+	}
+	if applied == "" {
+		return changed
+	}
+	for _, key := range strings.Split(applied, ",") {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		if _, ok := existing[key]; ok {
+			changed[key] = nil
+		}
+	}
+	return changed
+}
+
+// diffPatch returns a JSON merge patch, as a map, turning existing in to
+// wanted: fields only existing has are nulled, objects are compared field by
+// field, and anything else that differs is replaced.
+func diffPatch(existing, wanted interface{}) (map[string]interface{}, error) {
+	var from, to map[string]interface{}
+	for _, obj := range []struct {
+		value interface{}
+		doc   *map[string]interface{}
+	}{{existing, &from}, {wanted, &to}} {
+		data, err := json.Marshal(obj.value)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, obj.doc); err != nil {
+			return nil, err
+		}
+	}
+	return diffDocs(from, to), nil
+}
+
+func diffDocs(existing, wanted map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key := range existing {
+		if _, ok := wanted[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	for key, value := range wanted {
+		current, ok := existing[key]
+		if ok && reflect.DeepEqual(current, value) {
+			continue
+		}
+		wantedDoc, isDoc := value.(map[string]interface{})
+		currentDoc, wasDoc := current.(map[string]interface{})
+		if isDoc && wasDoc {
+			patch[key] = diffDocs(currentDoc, wantedDoc)
+		} else {
+			patch[key] = value
+		}
+	}
+	return patch
+}
+
+// desiredPorts fills in the defaults the API server would give the wanted
+// ports, and the NodePorts already allocated to them unless it is a ClusterIP
+// service, so they can be compared with the existing ports.
+func desiredPorts(wanted, existing []v1.ServicePort, serviceType v1.ServiceType) []v1.ServicePort {
+	ports := make([]v1.ServicePort, len(wanted))
+	for i, port := range wanted {
+		if port.Protocol == "" {
+			port.Protocol = v1.ProtocolTCP
+		}
+		if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+			port.TargetPort = intstr.FromInt(int(port.Port))
+		}
+		if port.NodePort == 0 && serviceType != v1.ServiceTypeClusterIP {
+			for _, current := range existing {
+				if current.Name == port.Name && current.Port == port.Port && current.Protocol == port.Protocol {
+					port.NodePort = current.NodePort
+				}
+			}
+		}
+		ports[i] = port
+	}
+	return ports
+}
@@ -0,0 +1,219 @@
+package apply
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/theobarberbany/learning-client-go/apply/applytest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestDesiredPorts(t *testing.T) {
+	existing := []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8888), NodePort: 30080}}
+
+	//The API server's defaults are filled in, and the NodePort kept
+	ports := desiredPorts([]v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(8888)}}, existing, v1.ServiceTypeNodePort)
+	assert.Equal(t, existing, ports)
+	ports = desiredPorts([]v1.ServicePort{{Name: "ssh", Port: 22}}, existing, v1.ServiceTypeNodePort)
+	assert.Equal(t, []v1.ServicePort{{Name: "ssh", Port: 22, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(22)}}, ports)
+
+	//but not for ClusterIP services, which can't have one
+	ports = desiredPorts([]v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(8888)}}, existing, v1.ServiceTypeClusterIP)
+	assert.Equal(t, int32(0), ports[0].NodePort)
+}
+
+func TestService(t *testing.T) {
+	var patches []map[string]interface{}
+	clientset := applytest.NewFakeClientset(&patches)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "jupyter", Namespace: "team", Labels: map[string]string{"app": "jupyter"}},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeNodePort,
+			Selector: map[string]string{"app": "jupyter", "user": "alice"},
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(8888)}},
+		},
+	}
+	_, result, err := Service(clientset, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, result)
+
+	//Pretend the API server allocated a NodePort and defaulted the rest
+	current, err := clientset.CoreV1().Services("team").Get("jupyter", metav1.GetOptions{})
+	assert.NoError(t, err)
+	current.Spec.Ports = desiredPorts(current.Spec.Ports, nil, v1.ServiceTypeNodePort)
+	current.Spec.Ports[0].NodePort = 30080
+	current.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	_, err = clientset.CoreV1().Services("team").Update(current)
+	assert.NoError(t, err)
+
+	_, result, err = Service(clientset, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, Unchanged, result)
+	assert.Empty(t, patches)
+
+	//A key dropped from the selector is deleted, not left behind by the merge
+	svc.Spec.Selector = map[string]string{"app": "jupyter"}
+	updated, result, err := Service(clientset, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, map[string]interface{}{"app": "jupyter", "user": nil}, patches[0]["spec"].(map[string]interface{})["selector"])
+	assert.Equal(t, svc.Spec.Selector, updated.Spec.Selector)
+	assert.Equal(t, int32(30080), updated.Spec.Ports[0].NodePort)
+
+	//Becoming ClusterIP drops what only services exposed outside have
+	svc.Spec.Type = v1.ServiceTypeClusterIP
+	updated, result, err = Service(clientset, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, v1.ServiceTypeClusterIP, updated.Spec.Type)
+	assert.Equal(t, int32(0), updated.Spec.Ports[0].NodePort)
+	assert.Equal(t, v1.ServiceExternalTrafficPolicyType(""), updated.Spec.ExternalTrafficPolicy)
+}
+
+func TestDeployment(t *testing.T) {
+	var patches []map[string]interface{}
+	clientset := applytest.NewFakeClientset(&patches)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "jupyter", Namespace: "team"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "jupyter"}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "jupyter"}},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "jupyter", Image: "skippbox/jupyter:0.0.3"}}},
+			},
+		},
+	}
+	created, result, err := Deployment(clientset, deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, result)
+	hash := created.ObjectMeta.Annotations[TemplateHashAnnotation]
+	assert.NotEmpty(t, hash)
+	assert.Nil(t, deployment.ObjectMeta.Annotations, "the wanted deployment isn't changed")
+
+	_, result, err = Deployment(clientset, deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, Unchanged, result)
+
+	//Being scaled only patches the replicas
+	scaled := int32(0)
+	current, err := clientset.AppsV1().Deployments("team").Get("jupyter", metav1.GetOptions{})
+	assert.NoError(t, err)
+	current.Spec.Replicas = &scaled
+	_, err = clientset.AppsV1().Deployments("team").Update(current)
+	assert.NoError(t, err)
+	updated, result, err := Deployment(clientset, deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, map[string]interface{}{"replicas": float64(1)}, patches[0]["spec"])
+	assert.Equal(t, int32(1), *updated.Spec.Replicas)
+
+	//A new template replaces the old one, with a new hash
+	deployment.Spec.Template.Spec.Containers[0].Image = "jupyter/base-notebook"
+	deployment.Spec.Template.ObjectMeta.Labels["repo"] = "python-client"
+	deployment.Spec.Template.Spec.InitContainers = []v1.Container{{Name: "clone", Image: "alpine/git"}}
+	deployment.Spec.Template.Spec.Volumes = []v1.Volume{{Name: "notebooks"}}
+	updated, result, err = Deployment(clientset, deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, "jupyter/base-notebook", updated.Spec.Template.Spec.Containers[0].Image)
+	assert.Len(t, updated.Spec.Template.Spec.InitContainers, 1)
+	assert.NotEqual(t, hash, updated.ObjectMeta.Annotations[TemplateHashAnnotation])
+
+	//Whatever the new template leaves out is removed from the old one
+	deployment.Spec.Template.Spec.InitContainers = nil
+	deployment.Spec.Template.Spec.Volumes = nil
+	delete(deployment.Spec.Template.ObjectMeta.Labels, "repo")
+	updated, result, err = Deployment(clientset, deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	template := patches[len(patches)-1]["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"repo": nil}},
+		"spec":     map[string]interface{}{"initContainers": nil, "volumes": nil},
+	}, template)
+	assert.Empty(t, updated.Spec.Template.Spec.InitContainers)
+	assert.Empty(t, updated.Spec.Template.Spec.Volumes)
+	assert.Equal(t, map[string]string{"app": "jupyter"}, updated.Spec.Template.ObjectMeta.Labels)
+	assert.Equal(t, "jupyter/base-notebook", updated.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestPod(t *testing.T) {
+	var patches []map[string]interface{}
+	clientset := applytest.NewFakeClientset(&patches)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "jupyter", Namespace: "team", Labels: map[string]string{"app": "jupyter"}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "jupyter", Image: "skippbox/jupyter:0.0.3"}}},
+	}
+	created, result, err := Pod(clientset, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, result)
+	hash := created.ObjectMeta.Annotations[SpecHashAnnotation]
+
+	_, result, err = Pod(clientset, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, Unchanged, result)
+
+	pod.ObjectMeta.Labels["user"] = "alice"
+	updated, result, err := Pod(clientset, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, "alice", updated.ObjectMeta.Labels["user"])
+
+	//A different spec can't be applied, so is reported, and the pod's hash
+	//left as the spec it has
+	pod.Spec.Containers[0].Image = "jupyter/base-notebook"
+	pod.ObjectMeta.Labels["profile"] = "small"
+	updated, result, err = Pod(clientset, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, Outdated, result)
+	assert.Equal(t, "small", updated.ObjectMeta.Labels["profile"])
+	assert.Equal(t, hash, updated.ObjectMeta.Annotations[SpecHashAnnotation])
+	_, result, err = Pod(clientset, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, Outdated, result)
+}
+
+func TestPersistentVolumeClaim(t *testing.T) {
+	var patches []map[string]interface{}
+	clientset := applytest.NewFakeClientset(&patches)
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "home-alice", Namespace: "team"},
+		Spec:       v1.PersistentVolumeClaimSpec{AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}},
+	}
+	_, result, err := PersistentVolumeClaim(clientset, claim)
+	assert.NoError(t, err)
+	assert.Equal(t, Created, result)
+
+	//Labels and annotations are added to the ones already there
+	claim.ObjectMeta.Labels = map[string]string{"user": "alice"}
+	updated, result, err := PersistentVolumeClaim(clientset, claim)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, map[string]interface{}{"metadata": map[string]interface{}{
+		"labels":      map[string]interface{}{"user": "alice"},
+		"annotations": map[string]interface{}{LabelsAnnotation: "user"},
+	}}, patches[0])
+	assert.Equal(t, "alice", updated.ObjectMeta.Labels["user"])
+
+	//Ones applied before but no longer wanted are deleted, and ones added by
+	//someone else left alone
+	updated.ObjectMeta.Labels["backup"] = "daily"
+	updated.ObjectMeta.Annotations["note"] = "keep"
+	_, err = clientset.CoreV1().PersistentVolumeClaims("team").Update(updated)
+	assert.NoError(t, err)
+	claim.ObjectMeta.Labels = map[string]string{"team": "data"}
+	updated, result, err = PersistentVolumeClaim(clientset, claim)
+	assert.NoError(t, err)
+	assert.Equal(t, Updated, result)
+	assert.Equal(t, map[string]string{"team": "data", "backup": "daily"}, updated.ObjectMeta.Labels)
+	assert.Equal(t, "keep", updated.ObjectMeta.Annotations["note"])
+	assert.Equal(t, "team", updated.ObjectMeta.Annotations[LabelsAnnotation])
+	_, result, err = PersistentVolumeClaim(clientset, claim)
+	assert.NoError(t, err)
+	assert.Equal(t, Unchanged, result)
+}
@@ -0,0 +1,77 @@
+// Package applytest has test helpers for code using the apply package.
+package applytest
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// NewFakeClientset returns a fake clientset holding the given objects which,
+// unlike the one from NewSimpleClientset, can apply the merge patches the
+// apply package makes. If patches isn't nil the patches made are recorded in
+// it.
+func NewFakeClientset(patches *[]map[string]interface{}, objects ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	clientset := &fake.Clientset{}
+	clientset.AddReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		obj, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		var doc, changes map[string]interface{}
+		original, err := json.Marshal(obj)
+		if err == nil {
+			err = json.Unmarshal(original, &doc)
+		}
+		if err == nil {
+			err = json.Unmarshal(patch.GetPatch(), &changes)
+		}
+		if err != nil {
+			return true, nil, err
+		}
+		if patches != nil {
+			*patches = append(*patches, changes)
+		}
+		merged, err := json.Marshal(MergePatch(doc, changes))
+		if err != nil {
+			return true, nil, err
+		}
+		patched := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(merged, patched); err != nil {
+			return true, nil, err
+		}
+		return true, patched, tracker.Update(patch.GetResource(), patched, patch.GetNamespace())
+	})
+	clientset.AddReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	return clientset
+}
+
+// MergePatch applies a JSON merge patch to doc.
+func MergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(doc, key)
+		case map[string]interface{}:
+			current, _ := doc[key].(map[string]interface{})
+			doc[key] = MergePatch(current, value)
+		default:
+			doc[key] = value
+		}
+	}
+	return doc
+}
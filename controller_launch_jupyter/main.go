@@ -23,28 +23,168 @@ import (
 
 	"github.com/golang/glog"
 
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/workqueue"
 )
 
+// ownedSelector selects the objects made for Notebooks.
+const ownedSelector = "app=jupyter,notebook"
+
+// Controller reconciles Notebooks into a deployment running the notebook
+// server and a service exposing it, and reports how they're doing in the
+// Notebook's status.
 type Controller struct {
+	clientset kubernetes.Interface
+	// client is a dynamic client for the Notebook API group.
+	client dynamic.Interface
+	// gitImage runs the init container that clones a Notebook's repo.
+	gitImage string
+
 	indexer  cache.Indexer
 	queue    workqueue.RateLimitingInterface
 	informer cache.Controller
+	// owned are informers on the deployments, services and pods made for
+	// Notebooks, which queue their Notebook when they change.
+	owned []cache.Controller
 }
 
-func NewController(queue workqueue.RateLimitingInterface, indexer cache.Indexer, informer cache.Controller) *Controller {
-	return &Controller{
-		informer: informer,
-		indexer:  indexer,
-		queue:    queue,
+func NewController(clientset kubernetes.Interface, client dynamic.Interface, namespace, gitImage string) *Controller {
+	c := &Controller{
+		clientset: clientset,
+		client:    client,
+		gitImage:  gitImage,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	notebookListWatcher := &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			return client.Resource(notebookResource, namespace).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			return client.Resource(notebookResource, namespace).Watch(options)
+		},
+	}
+	// Bind the workqueue to a cache with the help of an informer. This way we make sure that
+	// whenever the cache is updated, the Notebook key is added to the workqueue.
+	// Note that when we finally process the item from the workqueue, we might see a newer version
+	// of the Notebook than the version which was responsible for triggering the update.
+	c.indexer, c.informer = cache.NewIndexerInformer(notebookListWatcher, &unstructured.Unstructured{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// IndexerInformer uses a delta queue, therefore for deletes we have to use this
+			// key function.
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+	}, cache.Indexers{})
+
+	deploymentListWatcher := &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.AppsV1().Deployments(namespace).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.AppsV1().Deployments(namespace).Watch(options)
+		},
+	}
+	serviceListWatcher := &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.CoreV1().Services(namespace).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.CoreV1().Services(namespace).Watch(options)
+		},
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueOwner,
+		UpdateFunc: func(old interface{}, new interface{}) {
+			c.enqueueOwner(new)
+		},
+		DeleteFunc: c.enqueueOwner,
+	}
+	// Pods are controlled by the deployment's replica sets rather than the
+	// Notebook, so are traced back to it by their label.
+	podListWatcher := &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.CoreV1().Pods(namespace).List(options)
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = ownedSelector
+			return clientset.CoreV1().Pods(namespace).Watch(options)
+		},
+	}
+	podHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueLabelled,
+		UpdateFunc: func(old interface{}, new interface{}) {
+			c.enqueueLabelled(new)
+		},
+		DeleteFunc: c.enqueueLabelled,
+	}
+	_, deploymentInformer := cache.NewInformer(deploymentListWatcher, &appsv1.Deployment{}, 0, handler)
+	_, serviceInformer := cache.NewInformer(serviceListWatcher, &v1.Service{}, 0, handler)
+	_, podInformer := cache.NewInformer(podListWatcher, &v1.Pod{}, 0, podHandler)
+	c.owned = []cache.Controller{deploymentInformer, serviceInformer, podInformer}
+	return c
+}
+
+// enqueueOwner queues the Notebook that controls obj, if one does, so that
+// it's put back the way it should be and its status kept up to date.
+func (c *Controller) enqueueOwner(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	ref := meta_v1.GetControllerOf(object)
+	if ref == nil || ref.Kind != notebookResource.Kind || ref.APIVersion != notebookGroupVersion.String() {
+		return
+	}
+	c.queue.Add(object.GetNamespace() + "/" + ref.Name)
+}
+
+// enqueueLabelled queues the Notebook named by obj's notebook label, so its
+// status follows the pods running it.
+func (c *Controller) enqueueLabelled(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	if name := object.GetLabels()["notebook"]; name != "" {
+		c.queue.Add(object.GetNamespace() + "/" + name)
 	}
 }
 
@@ -55,38 +195,17 @@ func (c *Controller) processNextItem() bool {
 		return false
 	}
 	// Tell the queue that we are done with processing this key. This unblocks the key for other workers
-	// This allows safe parallel processing because two pods with the same key are never processed in
+	// This allows safe parallel processing because two Notebooks with the same key are never processed in
 	// parallel.
 	defer c.queue.Done(key)
 
 	// Invoke the method containing the business logic
-	err := c.syncToStdout(key.(string))
+	err := c.sync(key.(string))
 	// Handle the error if something went wrong during the execution of the business logic
 	c.handleErr(err, key)
 	return true
 }
 
-// syncToStdout is the business logic of the controller. In this controller it simply prints
-// information about the pod to stdout. In case an error happened, it has to simply return the error.
-// The retry logic should not be part of the business logic.
-func (c *Controller) syncToStdout(key string) error {
-	obj, exists, err := c.indexer.GetByKey(key)
-	if err != nil {
-		glog.Errorf("Fetching object with key %s from store failed with %v", key, err)
-		return err
-	}
-
-	if !exists {
-		// Below we will warm up our cache with a Pod, so that we will see a delete for one pod
-		fmt.Printf("Pod %s does not exist anymore\n", key)
-	} else {
-		// Note that you also have to check the uid if you have a local controlled resource, which
-		// is dependent on the actual instance, to detect that a Pod was recreated with the same name
-		fmt.Printf("Sync/Add/Update for Pod %s\n", obj.(*v1.Pod).GetName())
-	}
-	return nil
-}
-
 // handleErr checks if an error happened and makes sure we will retry later.
 func (c *Controller) handleErr(err error, key interface{}) {
 	if err == nil {
@@ -99,7 +218,7 @@ func (c *Controller) handleErr(err error, key interface{}) {
 
 	// This controller retries 5 times if something goes wrong. After that, it stops trying.
 	if c.queue.NumRequeues(key) < 5 {
-		glog.Infof("Error syncing pod %v: %v", key, err)
+		glog.Infof("Error syncing notebook %v: %v", key, err)
 
 		// Re-enqueue the key rate limited. Based on the rate limiter on the
 		// queue and the re-enqueue history, the key will be processed later again.
@@ -109,22 +228,27 @@ func (c *Controller) handleErr(err error, key interface{}) {
 
 	c.queue.Forget(key)
 	// Report to an external entity that, even after several retries, we could not successfully process this key
-	runtime.HandleError(err)
-	glog.Infof("Dropping pod %q out of the queue: %v", key, err)
+	utilruntime.HandleError(err)
+	glog.Infof("Dropping notebook %q out of the queue: %v", key, err)
 }
 
 func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
-	defer runtime.HandleCrash()
+	defer utilruntime.HandleCrash()
 
 	// Let the workers stop when we are done
 	defer c.queue.ShutDown()
-	glog.Info("Starting Pod controller")
+	glog.Info("Starting Notebook controller")
 
+	synced := []cache.InformerSynced{c.informer.HasSynced}
 	go c.informer.Run(stopCh)
+	for _, informer := range c.owned {
+		go informer.Run(stopCh)
+		synced = append(synced, informer.HasSynced)
+	}
 
 	// Wait for all involved caches to be synced, before processing items from the queue is started
-	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
-		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
 
@@ -133,7 +257,7 @@ func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
 	}
 
 	<-stopCh
-	glog.Info("Stopping Pod controller")
+	glog.Info("Stopping Notebook controller")
 }
 
 func (c *Controller) runWorker() {
@@ -144,9 +268,15 @@ func (c *Controller) runWorker() {
 func main() {
 	var kubeconfig string
 	var master string
+	var namespace string
+	var gitImage string
+	var threadiness int
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	flag.StringVar(&master, "master", "", "master url")
+	flag.StringVar(&namespace, "namespace", meta_v1.NamespaceAll, "namespace to reconcile Notebooks in (default all)")
+	flag.StringVar(&gitImage, "git-image", "alpine/git", "image to clone Notebooks' repos with")
+	flag.IntVar(&threadiness, "threadiness", 2, "number of Notebooks to reconcile at once")
 	flag.Parse()
 
 	// creates the connection
@@ -161,56 +291,22 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	// create the pod watcher
-	podListWatcher := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "pods", v1.NamespaceDefault, fields.Everything())
-
-	// create the workqueue
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
-
-	// Bind the workqueue to a cache with the help of an informer. This way we make sure that
-	// whenever the cache is updated, the pod key is added to the workqueue.
-	// Note that when we finally process the item from the workqueue, we might see a newer version
-	// of the Pod than the version which was responsible for triggering the update.
-	indexer, informer := cache.NewIndexerInformer(podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(obj)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-		UpdateFunc: func(old interface{}, new interface{}) {
-			key, err := cache.MetaNamespaceKeyFunc(new)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-		DeleteFunc: func(obj interface{}) {
-			// IndexerInformer uses a delta queue, therefore for deletes we have to use this
-			// key function.
-			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			if err == nil {
-				queue.Add(key)
-			}
-		},
-	}, cache.Indexers{})
-
-	controller := NewController(queue, indexer, informer)
+	// creates the dynamic client for Notebooks, which has to be told their
+	// API group
+	notebookConfig := *config
+	notebookConfig.GroupVersion = &notebookGroupVersion
+	notebookConfig.APIPath = "/apis"
+	client, err := dynamic.NewClient(&notebookConfig)
+	if err != nil {
+		glog.Fatal(err)
+	}
 
-	// We can now warm up the cache for initial synchronization.
-	// Let's suppose that we knew about a pod "mypod" on our last run, therefore add it to the cache.
-	// If this pod is not there anymore, the controller will be notified about the removal after the
-	// cache has synchronized.
-	indexer.Add(&v1.Pod{
-		ObjectMeta: meta_v1.ObjectMeta{
-			Name:      "mypod",
-			Namespace: v1.NamespaceDefault,
-		},
-	})
+	controller := NewController(clientset, client, namespace, gitImage)
 
 	// Now let's start the controller
 	stop := make(chan struct{})
 	defer close(stop)
-	go controller.Run(1, stop)
+	go controller.Run(threadiness, stop)
 
 	// Wait forever
 	select {}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The Notebook custom resource, defined by notebook-crd.yaml.
+var (
+	notebookGroupVersion = schema.GroupVersion{Group: "jupyter.example.com", Version: "v1alpha1"}
+	notebookResource     = &meta_v1.APIResource{Name: "notebooks", Namespaced: true, Kind: "Notebook"}
+)
+
+const (
+	// defaultImage is the notebook server run for Notebooks that don't say.
+	defaultImage = "skippbox/jupyter:0.0.3"
+	// notebookPort is the port notebook servers listen on.
+	notebookPort = 8888
+	// workVolume is the name of the volume the repo is cloned into.
+	workVolume = "work"
+)
+
+// cloneScript clones $REPO in to $DEST, an empty volume, checking out $REF
+// (a branch, tag or commit) if given. Anything left by an earlier attempt is
+// removed first, as the volume outlives a failed init container.
+const cloneScript = `set -e
+find "$DEST" -mindepth 1 -delete
+if [ -z "$REF" ]; then
+  exec git clone --depth 1 -- "$REPO" "$DEST"
+fi
+git init -q "$DEST"
+git -C "$DEST" remote add origin "$REPO"
+git -C "$DEST" fetch --depth 1 origin "$REF"
+git -C "$DEST" checkout -q FETCH_HEAD
+`
+
+// Phases of a Notebook.
+const (
+	phasePending = "Pending"
+	phaseRunning = "Running"
+	phaseFailed  = "Failed"
+)
+
+// notebookSpec is what a Notebook asks for.
+type notebookSpec struct {
+	Image string `json:"image"`
+	// Repo is a git repository to clone into ~/work before the notebook
+	// starts, at Ref, a branch, tag or commit, if it's set.
+	Repo string `json:"repo"`
+	Ref  string `json:"ref"`
+	// Resources are the notebook container's requests and limits.
+	Resources v1.ResourceRequirements `json:"resources"`
+	// Exposure is the type of the notebook's service: ClusterIP (the
+	// default), NodePort or LoadBalancer.
+	Exposure v1.ServiceType `json:"exposure"`
+}
+
+// notebookStatus is what the controller reports about a Notebook.
+type notebookStatus struct {
+	Phase string `json:"phase"`
+	// URL is where the notebook can be reached, once it can be. The token to
+	// log in with is in the secret TokenSecret.
+	URL         string `json:"url,omitempty"`
+	TokenSecret string `json:"tokenSecret,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// notebook is a Notebook with its spec decoded and defaulted.
+type notebook struct {
+	obj  *unstructured.Unstructured
+	spec notebookSpec
+	// gitImage runs the init container that clones the repo.
+	gitImage string
+}
+
+// newNotebook decodes the Notebook's spec, filling in the defaults.
+func newNotebook(obj *unstructured.Unstructured, gitImage string) (*notebook, error) {
+	n := &notebook{obj: obj, gitImage: gitImage}
+	if spec, ok := obj.Object["spec"]; ok {
+		data, err := json.Marshal(spec)
+		if err == nil {
+			err = json.Unmarshal(data, &n.spec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad spec: %v", err)
+		}
+	}
+	if n.spec.Image == "" {
+		n.spec.Image = defaultImage
+	}
+	switch n.spec.Exposure {
+	case "":
+		n.spec.Exposure = v1.ServiceTypeClusterIP
+	case v1.ServiceTypeClusterIP, v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer:
+	default:
+		return nil, fmt.Errorf("unknown exposure %q, must be ClusterIP, NodePort or LoadBalancer", n.spec.Exposure)
+	}
+	if n.spec.Ref != "" && n.spec.Repo == "" {
+		return nil, fmt.Errorf("ref %q given without a repo", n.spec.Ref)
+	}
+	return n, nil
+}
+
+// currentStatus returns the status the controller last wrote to the Notebook.
+func currentStatus(obj *unstructured.Unstructured) notebookStatus {
+	var s notebookStatus
+	if data, err := json.Marshal(obj.Object["status"]); err == nil {
+		json.Unmarshal(data, &s)
+	}
+	return s
+}
+
+// withStatus returns a copy of the Notebook with the status.
+func withStatus(obj *unstructured.Unstructured, s notebookStatus) (*unstructured.Unstructured, error) {
+	var value map[string]interface{}
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj = obj.DeepCopy()
+	obj.Object["status"] = value
+	return obj, nil
+}
+
+// name is the name of the Notebook and its deployment and service.
+func (n *notebook) name() string {
+	return n.obj.GetName()
+}
+
+// tokenSecretName is the name of the secret with the notebook's token.
+func (n *notebook) tokenSecretName() string {
+	return n.name() + "-token"
+}
+
+// labels are put on all the Notebook's objects and pods.
+func (n *notebook) labels() map[string]string {
+	return map[string]string{
+		"app":      "jupyter",
+		"notebook": n.name(),
+	}
+}
+
+// objectMeta is the metadata of the Notebook's objects, which it controls so
+// they're deleted along with it.
+func (n *notebook) objectMeta(name string) meta_v1.ObjectMeta {
+	return meta_v1.ObjectMeta{
+		Name:            name,
+		Namespace:       n.obj.GetNamespace(),
+		Labels:          n.labels(),
+		OwnerReferences: []meta_v1.OwnerReference{*meta_v1.NewControllerRef(n.obj, notebookGroupVersion.WithKind(notebookResource.Kind))},
+	}
+}
+
+// tokenSecret holds a new token for the notebook. It's made once and kept
+// for the life of the Notebook.
+func (n *notebook) tokenSecret() (*v1.Secret, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate a token: %v", err)
+	}
+	return &v1.Secret{
+		ObjectMeta: n.objectMeta(n.tokenSecretName()),
+		StringData: map[string]string{"token": hex.EncodeToString(b)},
+	}, nil
+}
+
+// deployment runs a single notebook server, with the repo cloned into its
+// work directory.
+func (n *notebook) deployment() *appsv1.Deployment {
+	replicas := int32(1)
+	pod := v1.PodSpec{
+		Containers: []v1.Container{
+			{
+				Name:  "jupyter",
+				Image: n.spec.Image,
+				Env: []v1.EnvVar{
+					{
+						Name: "JUPYTER_TOKEN",
+						ValueFrom: &v1.EnvVarSource{
+							SecretKeyRef: &v1.SecretKeySelector{
+								LocalObjectReference: v1.LocalObjectReference{Name: n.tokenSecretName()},
+								Key:                  "token",
+							},
+						},
+					},
+				},
+				Resources: n.spec.Resources,
+				Ports: []v1.ContainerPort{
+					{
+						Name:          "http",
+						Protocol:      v1.ProtocolTCP,
+						ContainerPort: notebookPort,
+					},
+				},
+				//Ready once the notebook server is listening
+				ReadinessProbe: &v1.Probe{
+					Handler: v1.Handler{
+						TCPSocket: &v1.TCPSocketAction{
+							Port: intstr.FromString("http"),
+						},
+					},
+					PeriodSeconds: 2,
+				},
+			},
+		},
+	}
+	if n.spec.Repo != "" {
+		pod.Volumes = []v1.Volume{{Name: workVolume, VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+		mounts := []v1.VolumeMount{{Name: workVolume, MountPath: "/root/work"}}
+		pod.InitContainers = []v1.Container{
+			{
+				Name:    "clone",
+				Image:   n.gitImage,
+				Command: []string{"/bin/sh", "-c", cloneScript},
+				Env: []v1.EnvVar{
+					{Name: "REPO", Value: n.spec.Repo},
+					{Name: "REF", Value: n.spec.Ref},
+					{Name: "DEST", Value: "/root/work"},
+				},
+				VolumeMounts: mounts,
+			},
+		}
+		pod.Containers[0].VolumeMounts = mounts
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: n.objectMeta(n.name()),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &meta_v1.LabelSelector{
+				MatchLabels: n.labels(),
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: meta_v1.ObjectMeta{
+					Labels: n.labels(),
+				},
+				Spec: pod,
+			},
+		},
+	}
+}
+
+// service exposes the notebook the way the Notebook asks.
+func (n *notebook) service() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: n.objectMeta(n.name()),
+		Spec: v1.ServiceSpec{
+			Type:     n.spec.Exposure,
+			Selector: n.labels(),
+			Ports: []v1.ServicePort{
+				{
+					Port:       80,
+					Name:       "http",
+					TargetPort: intstr.FromInt(notebookPort),
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func notebookObject(spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "jupyter.example.com/v1alpha1",
+		"kind":       "Notebook",
+		"metadata": map[string]interface{}{
+			"name":      "python-client",
+			"namespace": "team",
+			"uid":       "nb1",
+		},
+	}}
+	if spec != nil {
+		obj.Object["spec"] = spec
+	}
+	return obj
+}
+
+func TestNewNotebook(t *testing.T) {
+	n, err := newNotebook(notebookObject(nil), "alpine/git")
+	assert.NoError(t, err)
+	assert.Equal(t, notebookSpec{Image: defaultImage, Exposure: v1.ServiceTypeClusterIP}, n.spec)
+
+	n, err = newNotebook(notebookObject(map[string]interface{}{
+		"repo": "https://github.com/kubernetes-client/python.git",
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"memory": "1Gi"},
+		},
+		"exposure": "LoadBalancer",
+	}), "alpine/git")
+	assert.NoError(t, err)
+	assert.Equal(t, resource.MustParse("1Gi"), n.spec.Resources.Requests[v1.ResourceMemory])
+	assert.Equal(t, v1.ServiceTypeLoadBalancer, n.spec.Exposure)
+
+	_, err = newNotebook(notebookObject(map[string]interface{}{"exposure": "Ingress"}), "alpine/git")
+	assert.EqualError(t, err, `unknown exposure "Ingress", must be ClusterIP, NodePort or LoadBalancer`)
+	_, err = newNotebook(notebookObject(map[string]interface{}{"ref": "master"}), "alpine/git")
+	assert.Error(t, err)
+	_, err = newNotebook(notebookObject(map[string]interface{}{"resources": "lots"}), "alpine/git")
+	assert.Error(t, err)
+}
+
+func TestNotebookObjects(t *testing.T) {
+	nb := notebookObject(map[string]interface{}{
+		"repo": "https://github.com/kubernetes-client/python.git",
+		"ref":  "v5.0.0",
+	})
+	n, err := newNotebook(nb, "alpine/git")
+	assert.NoError(t, err)
+
+	//Everything is controlled by the Notebook, so it's deleted with it
+	deployment := n.deployment()
+	svc := n.service()
+	secret, err := n.tokenSecret()
+	assert.NoError(t, err)
+	for _, obj := range []meta_v1.Object{deployment, svc, secret} {
+		assert.True(t, meta_v1.IsControlledBy(obj, nb), obj.GetName())
+		assert.Equal(t, "team", obj.GetNamespace())
+	}
+	assert.Equal(t, "python-client", deployment.ObjectMeta.Name)
+	assert.Equal(t, "python-client-token", secret.ObjectMeta.Name)
+	assert.Len(t, secret.StringData["token"], 48)
+
+	pod := deployment.Spec.Template.Spec
+	assert.Equal(t, []v1.EnvVar{
+		{Name: "REPO", Value: "https://github.com/kubernetes-client/python.git"},
+		{Name: "REF", Value: "v5.0.0"},
+		{Name: "DEST", Value: "/root/work"},
+	}, pod.InitContainers[0].Env)
+	assert.Equal(t, "python-client-token", pod.Containers[0].Env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, v1.ServiceTypeClusterIP, svc.Spec.Type)
+	assert.Equal(t, deployment.Spec.Template.ObjectMeta.Labels, svc.Spec.Selector)
+
+	//Status survives the round trip through the unstructured Notebook
+	status := notebookStatus{Phase: phaseRunning, URL: "http://python-client.team.svc/", TokenSecret: "python-client-token"}
+	updated, err := withStatus(nb, status)
+	assert.NoError(t, err)
+	assert.Equal(t, status, currentStatus(updated))
+	assert.Equal(t, notebookStatus{}, currentStatus(nb))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/theobarberbany/learning-client-go/apply"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// sync is the business logic of the controller. It reconciles the Notebook
+// into its objects and writes back its status. A deleted Notebook's objects
+// are left to the garbage collector, which deletes them because the Notebook
+// controls them.
+func (c *Controller) sync(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		glog.Errorf("Fetching object with key %s from store failed with %v", key, err)
+		return err
+	}
+	if !exists {
+		glog.Infof("Notebook %s does not exist anymore", key)
+		return nil
+	}
+	nb := obj.(*unstructured.Unstructured)
+	if nb.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	n, err := newNotebook(nb, c.gitImage)
+	if err != nil {
+		//Trying again won't help until the Notebook is changed
+		return c.updateStatus(nb, notebookStatus{Phase: phaseFailed, Message: err.Error()})
+	}
+	status, err := c.reconcile(n)
+	if err != nil {
+		if statusErr := c.updateStatus(nb, notebookStatus{Phase: phaseFailed, Message: err.Error()}); statusErr != nil {
+			glog.Errorf("Failed to update the status of notebook %s: %v", key, statusErr)
+		}
+		return err
+	}
+	return c.updateStatus(nb, status)
+}
+
+// reconcile makes the Notebook's token secret, deployment and service what
+// they should be, and returns the Notebook's status.
+func (c *Controller) reconcile(n *notebook) (notebookStatus, error) {
+	if err := c.ensureTokenSecret(n); err != nil {
+		return notebookStatus{}, err
+	}
+	deployment, err := c.ensureDeployment(n)
+	if err != nil {
+		return notebookStatus{}, err
+	}
+	svc, err := c.ensureService(n)
+	if err != nil {
+		return notebookStatus{}, err
+	}
+	status := notebookStatus{Phase: phasePending, TokenSecret: n.tokenSecretName()}
+	if deployment.Status.ReadyReplicas > 0 {
+		status.Phase = phaseRunning
+	} else {
+		status.Message, err = c.failure(n, deployment)
+		if err != nil {
+			return notebookStatus{}, err
+		}
+		if status.Message != "" {
+			status.Phase = phaseFailed
+		}
+	}
+	status.URL, err = c.url(svc)
+	return status, err
+}
+
+// failure returns why the notebook isn't going to start without help, or ""
+// if it's still starting: its deployment has given up, or one of its pods
+// can't clone the repo, pull an image or stay up.
+func (c *Controller) failure(n *notebook, deployment *appsv1.Deployment) (string, error) {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == v1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return condition.Message, nil
+		}
+	}
+	pods, err := c.clientset.CoreV1().Pods(n.obj.GetNamespace()).List(meta_v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(n.labels()).String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	for i := range pods.Items {
+		if message := podFailure(&pods.Items[i]); message != "" {
+			return message, nil
+		}
+	}
+	return "", nil
+}
+
+// podFailure returns why the pod can't start, or "" if it's starting or
+// running.
+func podFailure(pod *v1.Pod) string {
+	for _, status := range pod.Status.InitContainerStatuses {
+		//A failed init container is restarted, so it may be waiting to run
+		//again after failing.
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated != nil && terminated.ExitCode != 0 {
+			return fmt.Sprintf("init container %s of pod %s failed with exit code %d", status.Name, pod.ObjectMeta.Name, terminated.ExitCode)
+		}
+	}
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if waiting := status.State.Waiting; waiting != nil {
+			switch waiting.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CrashLoopBackOff", "CreateContainerConfigError":
+				return fmt.Sprintf("container %s of pod %s can't start: %s %s", status.Name, pod.ObjectMeta.Name, waiting.Reason, waiting.Message)
+			}
+		}
+	}
+	return ""
+}
+
+// checkControlled returns an error if the Notebook doesn't control the
+// object, so the controller doesn't take over objects it didn't make.
+func checkControlled(n *notebook, kind string, obj meta_v1.Object) error {
+	if !meta_v1.IsControlledBy(obj, n.obj) {
+		return fmt.Errorf("%s %s already exists and isn't controlled by notebook %s", kind, obj.GetName(), n.name())
+	}
+	return nil
+}
+
+// ensureTokenSecret makes the secret with the notebook's token if it doesn't
+// already exist.
+func (c *Controller) ensureTokenSecret(n *notebook) error {
+	secrets := c.clientset.CoreV1().Secrets(n.obj.GetNamespace())
+	secret, err := secrets.Get(n.tokenSecretName(), meta_v1.GetOptions{})
+	if err == nil {
+		return checkControlled(n, "Secret", secret)
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	secret, err = n.tokenSecret()
+	if err != nil {
+		return err
+	}
+	_, err = secrets.Create(secret)
+	return err
+}
+
+// ensureDeployment makes the notebook's deployment, or updates it if its pod
+// template isn't the one the Notebook asks for or it's been scaled.
+func (c *Controller) ensureDeployment(n *notebook) (*appsv1.Deployment, error) {
+	desired := n.deployment()
+	existing, err := c.clientset.AppsV1().Deployments(desired.ObjectMeta.Namespace).Get(desired.ObjectMeta.Name, meta_v1.GetOptions{})
+	if err == nil {
+		err = checkControlled(n, "Deployment", existing)
+	} else if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deployment, result, err := apply.Deployment(c.clientset, desired)
+	if err != nil {
+		return nil, err
+	}
+	if result != apply.Unchanged {
+		glog.Infof("Deployment %s/%s %s", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, result)
+	}
+	return deployment, nil
+}
+
+// ensureService makes the notebook's service, or updates it if it isn't
+// exposed the way the Notebook asks. Node ports are kept when they can be.
+func (c *Controller) ensureService(n *notebook) (*v1.Service, error) {
+	desired := n.service()
+	existing, err := c.clientset.CoreV1().Services(desired.ObjectMeta.Namespace).Get(desired.ObjectMeta.Name, meta_v1.GetOptions{})
+	if err == nil {
+		err = checkControlled(n, "Service", existing)
+	} else if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	svc, result, err := apply.Service(c.clientset, desired)
+	if err != nil {
+		return nil, err
+	}
+	if result != apply.Unchanged {
+		glog.Infof("Service %s/%s %s", desired.ObjectMeta.Namespace, desired.ObjectMeta.Name, result)
+	}
+	return svc, nil
+}
+
+// url returns where the notebook behind the service can be reached, or "" if
+// it can't be yet: inside the cluster for ClusterIP services, on a node's
+// address for NodePort ones and on the load balancer for LoadBalancer ones.
+func (c *Controller) url(svc *v1.Service) (string, error) {
+	switch svc.Spec.Type {
+	case v1.ServiceTypeNodePort:
+		if len(svc.Spec.Ports) == 0 || svc.Spec.Ports[0].NodePort == 0 {
+			return "", nil
+		}
+		address, err := c.nodeAddress()
+		if address == "" || err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("http://%s/", net.JoinHostPort(address, strconv.Itoa(int(svc.Spec.Ports[0].NodePort)))), nil
+	case v1.ServiceTypeLoadBalancer:
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				return fmt.Sprintf("http://%s/", ingress.IP), nil
+			}
+			if ingress.Hostname != "" {
+				return fmt.Sprintf("http://%s/", ingress.Hostname), nil
+			}
+		}
+		return "", nil
+	default:
+		return fmt.Sprintf("http://%s.%s.svc/", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace), nil
+	}
+}
+
+// nodeAddress returns an address of one of the nodes, external if it has
+// one, or "" if there are no nodes.
+func (c *Controller) nodeAddress() (string, error) {
+	nodes, err := c.clientset.CoreV1().Nodes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	var internal string
+	for _, node := range nodes.Items {
+		for _, address := range node.Status.Addresses {
+			switch {
+			case address.Type == v1.NodeExternalIP:
+				return address.Address, nil
+			case address.Type == v1.NodeInternalIP && internal == "":
+				internal = address.Address
+			}
+		}
+	}
+	return internal, nil
+}
+
+// updateStatus writes the status to the Notebook if it's changed. Notebooks
+// don't have a status subresource, so it's written with the rest of the
+// object.
+func (c *Controller) updateStatus(nb *unstructured.Unstructured, status notebookStatus) error {
+	if reflect.DeepEqual(currentStatus(nb), status) {
+		return nil
+	}
+	updated, err := withStatus(nb, status)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Resource(notebookResource, nb.GetNamespace()).Update(updated)
+	if err != nil {
+		return fmt.Errorf("failed to update status: %v", err)
+	}
+	glog.Infof("Notebook %s/%s is %s", nb.GetNamespace(), nb.GetName(), status.Phase)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/theobarberbany/learning-client-go/apply/applytest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newTestController returns a controller on the fake clientset with the
+// Notebook in its cache. The Notebooks it writes back are recorded in
+// updates, and put in the cache as the informer would.
+func newTestController(clientset *fake.Clientset, nb *unstructured.Unstructured, updates *[]*unstructured.Unstructured) *Controller {
+	client := &dynamicfake.FakeClient{GroupVersion: notebookGroupVersion, Fake: &k8stesting.Fake{}}
+	c := &Controller{
+		clientset: clientset,
+		client:    client,
+		gitImage:  "alpine/git",
+		indexer:   cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+	}
+	client.AddReactor("update", notebookResource.Name, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updated := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+		*updates = append(*updates, updated)
+		return true, updated, c.indexer.Update(updated)
+	})
+	c.indexer.Add(nb)
+	return c
+}
+
+func TestSync(t *testing.T) {
+	var updates []*unstructured.Unstructured
+	clientset := applytest.NewFakeClientset(nil)
+	c := newTestController(clientset, notebookObject(map[string]interface{}{
+		"repo": "https://github.com/kubernetes-client/python.git",
+	}), &updates)
+
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Len(t, updates, 1)
+	assert.Equal(t, notebookStatus{Phase: phasePending, URL: "http://python-client.team.svc/", TokenSecret: "python-client-token"}, currentStatus(updates[0]))
+	secret, err := clientset.CoreV1().Secrets("team").Get("python-client-token", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	token := secret.StringData["token"]
+
+	//Once the notebook is ready it's Running, and the token kept
+	deployment, err := clientset.AppsV1().Deployments("team").Get("python-client", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	deployment.Status.ReadyReplicas = 1
+	_, err = clientset.AppsV1().Deployments("team").Update(deployment)
+	assert.NoError(t, err)
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Len(t, updates, 2)
+	assert.Equal(t, phaseRunning, currentStatus(updates[1]).Phase)
+	secret, err = clientset.CoreV1().Secrets("team").Get("python-client-token", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, token, secret.StringData["token"])
+
+	//The status is only written when it changes
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Len(t, updates, 2)
+
+	//A deleted Notebook is left to the garbage collector
+	c.indexer.Delete(updates[1])
+	assert.NoError(t, c.sync("team/python-client"))
+}
+
+func TestSyncBadSpec(t *testing.T) {
+	var updates []*unstructured.Unstructured
+	c := newTestController(applytest.NewFakeClientset(nil), notebookObject(map[string]interface{}{"exposure": "Ingress"}), &updates)
+
+	//Retrying won't help, so it isn't an error
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Len(t, updates, 1)
+	assert.Equal(t, notebookStatus{Phase: phaseFailed, Message: `unknown exposure "Ingress", must be ClusterIP, NodePort or LoadBalancer`}, currentStatus(updates[0]))
+}
+
+func TestSyncNotControlled(t *testing.T) {
+	var updates []*unstructured.Unstructured
+	clientset := applytest.NewFakeClientset(nil, &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "python-client", Namespace: "team"}})
+	c := newTestController(clientset, notebookObject(nil), &updates)
+
+	assert.EqualError(t, c.sync("team/python-client"), "Service python-client already exists and isn't controlled by notebook python-client")
+	assert.Len(t, updates, 1)
+	assert.Equal(t, phaseFailed, currentStatus(updates[0]).Phase)
+	svc, err := clientset.CoreV1().Services("team").Get("python-client", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, svc.Spec.Selector, "the service isn't taken over")
+}
+
+func TestSyncFailed(t *testing.T) {
+	for name, pod := range map[string]v1.PodStatus{
+		"clone": {InitContainerStatuses: []v1.ContainerStatus{{
+			Name:                 "clone",
+			State:                v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			LastTerminationState: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 128}},
+		}}},
+		"image": {ContainerStatuses: []v1.ContainerStatus{{
+			Name:  "jupyter",
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+		}}},
+	} {
+		var updates []*unstructured.Unstructured
+		clientset := applytest.NewFakeClientset(nil, &v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "python-client-1", Namespace: "team", Labels: map[string]string{"app": "jupyter", "notebook": "python-client"}},
+			Status:     pod,
+		})
+		c := newTestController(clientset, notebookObject(nil), &updates)
+		assert.NoError(t, c.sync("team/python-client"), name)
+		assert.Equal(t, phaseFailed, currentStatus(updates[0]).Phase, name)
+	}
+	assert.Equal(t, "init container clone of pod python-client-1 failed with exit code 128", podFailure(&v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "python-client-1"},
+		Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{{
+			Name:  "clone",
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 128}},
+		}}},
+	}))
+	assert.Empty(t, podFailure(&v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+		Name:  "jupyter",
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+	}}}}))
+
+	//A deployment that's given up is Failed too, and recovers with its pod
+	var updates []*unstructured.Unstructured
+	clientset := applytest.NewFakeClientset(nil)
+	c := newTestController(clientset, notebookObject(nil), &updates)
+	assert.NoError(t, c.sync("team/python-client"))
+	deployment, err := clientset.AppsV1().Deployments("team").Get("python-client", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	deployment.Status.Conditions = []appsv1.DeploymentCondition{{
+		Type:    appsv1.DeploymentProgressing,
+		Status:  v1.ConditionFalse,
+		Reason:  "ProgressDeadlineExceeded",
+		Message: `ReplicaSet "python-client-1" has timed out progressing.`,
+	}}
+	_, err = clientset.AppsV1().Deployments("team").Update(deployment)
+	assert.NoError(t, err)
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Equal(t, notebookStatus{
+		Phase:       phaseFailed,
+		URL:         "http://python-client.team.svc/",
+		TokenSecret: "python-client-token",
+		Message:     `ReplicaSet "python-client-1" has timed out progressing.`,
+	}, currentStatus(updates[1]))
+	deployment.Status.ReadyReplicas = 1
+	_, err = clientset.AppsV1().Deployments("team").Update(deployment)
+	assert.NoError(t, err)
+	assert.NoError(t, c.sync("team/python-client"))
+	assert.Equal(t, phaseRunning, currentStatus(updates[2]).Phase)
+}
+
+func TestEnsure(t *testing.T) {
+	clientset := applytest.NewFakeClientset(nil)
+	c := &Controller{clientset: clientset}
+	n, err := newNotebook(notebookObject(nil), "alpine/git")
+	assert.NoError(t, err)
+	_, err = c.ensureDeployment(n)
+	assert.NoError(t, err)
+	_, err = c.ensureService(n)
+	assert.NoError(t, err)
+
+	//A new image rolls out a new template, and a scaled deployment is put back
+	deployment, err := clientset.AppsV1().Deployments("team").Get("python-client", meta_v1.GetOptions{})
+	assert.NoError(t, err)
+	scaled := int32(0)
+	deployment.Spec.Replicas = &scaled
+	_, err = clientset.AppsV1().Deployments("team").Update(deployment)
+	assert.NoError(t, err)
+	n.spec.Image = "jupyter/base-notebook"
+	deployment, err = c.ensureDeployment(n)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), *deployment.Spec.Replicas)
+	assert.Equal(t, "jupyter/base-notebook", deployment.Spec.Template.Spec.Containers[0].Image)
+
+	//A NodePort keeps the port it was given
+	n.spec.Exposure = v1.ServiceTypeNodePort
+	svc, err := c.ensureService(n)
+	assert.NoError(t, err)
+	svc.Spec.Ports[0].NodePort = 30080
+	_, err = clientset.CoreV1().Services("team").Update(svc)
+	assert.NoError(t, err)
+	svc, err = c.ensureService(n)
+	assert.NoError(t, err)
+	assert.Equal(t, v1.ServiceTypeNodePort, svc.Spec.Type)
+	assert.Equal(t, int32(30080), svc.Spec.Ports[0].NodePort)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Where the notebooks and git credentials are mounted in the clone container.
+const (
+	workspaceDir = "/workspace"
+	gitSecretDir = "/etc/git-secret"
+)
+
+// Keys of the git credentials Secret. ssh-privatekey and known_hosts are the
+// keys of a kubernetes.io/ssh-auth Secret, and an ssh key is only used with
+// the known hosts to check the server against; token (with an optional
+// username) is used for https.
+const (
+	sshKeyKey     = "ssh-privatekey"
+	knownHostsKey = "known_hosts"
+	tokenKey      = "token"
+	usernameKey   = "username"
+)
+
+// cloneScript clones $REPO in to $DEST, checking out $REF (a branch, tag or
+// commit) if given, with at most $DEPTH commits of history if it isn't 0. The
+// home directory is kept between launches, so an existing clone, perhaps with
+// the user's changes, is left alone.
+const cloneScript = `set -e
+if [ -f ` + gitSecretDir + `/` + sshKeyKey + ` ]; then
+  export GIT_SSH_COMMAND="ssh -i ` + gitSecretDir + `/` + sshKeyKey + ` -o UserKnownHostsFile=` + gitSecretDir + `/` + knownHostsKey + ` -o StrictHostKeyChecking=yes"
+fi
+if [ -f ` + gitSecretDir + `/` + tokenKey + ` ]; then
+  git config --global credential.helper '!f() { echo "username=$(cat ` + gitSecretDir + `/` + usernameKey + ` 2>/dev/null || echo x-access-token)"; echo "password=$(cat ` + gitSecretDir + `/` + tokenKey + `)"; }; f'
+fi
+depth=
+if [ "$DEPTH" != 0 ]; then
+  depth="--depth $DEPTH"
+fi
+if [ -e "$DEST" ]; then
+  echo "$DEST is already there, leaving it alone"
+  exit 0
+fi
+partial="$DEST.partial"
+rm -rf "$partial"
+if [ -z "$REF" ]; then
+  git clone $depth "$REPO" "$partial"
+else
+  git init -q "$partial"
+  git -C "$partial" remote add origin "$REPO"
+  git -C "$partial" fetch $depth origin "$REF"
+  git -C "$partial" checkout -q FETCH_HEAD
+fi
+mv "$partial" "$DEST"
+`
+
+// gitSource says which repository of notebooks to clone in to the pod, and
+// how.
+type gitSource struct {
+	Repo  string
+	Ref   string
+	Depth int
+	// Secret names a Secret in the pod's namespace with the credentials for
+	// a private repository.
+	Secret string
+	Image  string
+}
+
+// validate checks the options, and that the credentials Secret exists and
+// has something git can use.
+func (g *gitSource) validate(clientset kubernetes.Interface, namespace string) error {
+	if g.Repo == "" {
+		return fmt.Errorf("a repository to clone is required")
+	}
+	if g.Depth < 0 {
+		return fmt.Errorf("clone depth can't be negative")
+	}
+	if g.Secret == "" {
+		return nil
+	}
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(g.Secret, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get git credentials: %v", err)
+	}
+	if _, ok := secret.Data[sshKeyKey]; ok {
+		if _, ok := secret.Data[knownHostsKey]; !ok {
+			return fmt.Errorf("secret %s has a %s but no %s to check the server against", g.Secret, sshKeyKey, knownHostsKey)
+		}
+		return nil
+	}
+	if _, ok := secret.Data[tokenKey]; ok {
+		return nil
+	}
+	return fmt.Errorf("secret %s has neither a %s nor a %s", g.Secret, sshKeyKey, tokenKey)
+}
+
+// dir is the directory the repository is cloned in to, relative to the
+// notebook volume. Like a gitRepo volume, it is named after the repository.
+func (g *gitSource) dir() string {
+	return path.Base(strings.TrimSuffix(strings.TrimSuffix(g.Repo, "/"), ".git"))
+}
+
+// volumes returns the volumes the clone needs besides the notebook volume.
+func (g *gitSource) volumes() []v1.Volume {
+	if g.Secret == "" {
+		return nil
+	}
+	mode := int32(0400)
+	return []v1.Volume{
+		{
+			Name: "git-secret",
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName:  g.Secret,
+					DefaultMode: &mode,
+				},
+			},
+		},
+	}
+}
+
+// initContainer returns a container that clones the repository in to the
+// named volume.
+func (g *gitSource) initContainer(volume string) v1.Container {
+	container := v1.Container{
+		Name:    "git-clone",
+		Image:   g.Image,
+		Command: []string{"sh", "-c", cloneScript},
+		Env: []v1.EnvVar{
+			{Name: "REPO", Value: g.Repo},
+			{Name: "REF", Value: g.Ref},
+			{Name: "DEPTH", Value: strconv.Itoa(g.Depth)},
+			{Name: "DEST", Value: path.Join(workspaceDir, g.dir())},
+		},
+		VolumeMounts: []v1.VolumeMount{
+			{
+				Name:      volume,
+				MountPath: workspaceDir,
+			},
+		},
+	}
+	if g.Secret != "" {
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+			Name:      "git-secret",
+			MountPath: gitSecretDir,
+			ReadOnly:  true,
+		})
+	}
+	return container
+}
+
+// initContainerFailure returns an error if one of the pod's init containers
+// has failed, with the end of its log.
+func initContainerFailure(clientset kubernetes.Interface, pod *v1.Pod) error {
+	for _, status := range pod.Status.InitContainerStatuses {
+		//A failed init container is restarted, so it may be waiting to run
+		//again after failing.
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+		err := fmt.Errorf("init container %s failed with exit code %d", status.Name, terminated.ExitCode)
+		tail := int64(20)
+		logs, logErr := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).GetLogs(pod.ObjectMeta.Name, &v1.PodLogOptions{
+			Container: status.Name,
+			Previous:  status.State.Terminated == nil,
+			TailLines: &tail,
+		}).Stream()
+		if logErr != nil {
+			return err
+		}
+		defer logs.Close()
+		output, logErr := ioutil.ReadAll(logs)
+		if logErr != nil || len(output) == 0 {
+			return err
+		}
+		return fmt.Errorf("%v:\n%s", err, strings.TrimSuffix(string(output), "\n"))
+	}
+	return nil
+}
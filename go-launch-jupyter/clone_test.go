@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/theobarberbany/learning-client-go/apply/applytest"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGitSourceValidate(t *testing.T) {
+	clientset := applytest.NewFakeClientset(nil)
+	for name, data := range map[string]map[string][]byte{
+		"ssh":       {sshKeyKey: []byte("key"), knownHostsKey: []byte("github.com ssh-rsa AAAA")},
+		"ssh-blind": {sshKeyKey: []byte("key")},
+		"https":     {tokenKey: []byte("token")},
+		"empty":     {},
+	} {
+		_, err := clientset.CoreV1().Secrets("jupyter").Create(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "jupyter"},
+			Data:       data,
+		})
+		assert.NoError(t, err)
+	}
+
+	g := &gitSource{Repo: "git@github.com:team/notebooks.git", Secret: "ssh"}
+	assert.NoError(t, g.validate(clientset, "jupyter"))
+	g.Secret = "https"
+	assert.NoError(t, g.validate(clientset, "jupyter"))
+
+	//An ssh key is never used without known hosts to check the server against
+	g.Secret = "ssh-blind"
+	assert.EqualError(t, g.validate(clientset, "jupyter"), "secret ssh-blind has a ssh-privatekey but no known_hosts to check the server against")
+	g.Secret = "empty"
+	assert.EqualError(t, g.validate(clientset, "jupyter"), "secret empty has neither a ssh-privatekey nor a token")
+	g.Secret = "missing"
+	assert.Error(t, g.validate(clientset, "jupyter"))
+}
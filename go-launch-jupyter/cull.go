@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// lastActivityAnnotation may be set on a notebook pod to when it was last
+// used, in RFC 3339 format, for notebooks that can't say for themselves.
+const lastActivityAnnotation = "jupyter/last-activity"
+
+// What the culler does to idle notebooks.
+const (
+	// cullScale scales the notebook's deployment down to nothing, keeping its
+	// home directory, or deletes the pod if it isn't part of a deployment.
+	cullScale = "scale"
+	// cullDelete deletes the notebook's deployment, or its pod if it isn't
+	// part of one. Its claim and service are kept.
+	cullDelete = "delete"
+)
+
+// cullSelector selects the notebook pods the culler watches. Pods with a
+// notebook label belong to a Notebook of controller_launch_jupyter, which
+// would just scale them back up, so are left alone.
+const cullSelector = "app=jupyter,!notebook"
+
+// culler is a controller that culls notebooks that haven't been used for a
+// while. It watches the notebook pods in a namespace and checks each one
+// when it changes and again when it would become idle.
+type culler struct {
+	clientset kubernetes.Interface
+	indexer   cache.Indexer
+	queue     workqueue.RateLimitingInterface
+	informer  cache.Controller
+
+	// idle is how long a notebook may go unused before it's culled.
+	idle time.Duration
+	// action is cullScale or cullDelete.
+	action string
+	// port is the port notebooks' servers listen on.
+	port int
+	// client queries the notebook servers.
+	client *http.Client
+	now    func() time.Time
+}
+
+// newCuller returns a culler for the notebook pods in the namespace.
+func newCuller(clientset kubernetes.Interface, namespace string, idle time.Duration, action string) *culler {
+	c := &culler{
+		clientset: clientset,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		idle:      idle,
+		action:    action,
+		port:      notebookPort,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		now:       time.Now,
+	}
+	podListWatcher := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = cullSelector
+			return clientset.CoreV1().Pods(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = cullSelector
+			return clientset.CoreV1().Pods(namespace).Watch(options)
+		},
+	}
+	c.indexer, c.informer = cache.NewIndexerInformer(podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(key)
+			}
+		},
+	}, cache.Indexers{})
+	return c
+}
+
+func (c *culler) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	err := c.sync(key.(string))
+	c.handleErr(err, key)
+	return true
+}
+
+// sync culls the pod if it's idle, or otherwise checks it again when it would
+// be.
+func (c *culler) sync(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	pod := obj.(*v1.Pod)
+	if pod.ObjectMeta.DeletionTimestamp != nil || !podReady(pod) {
+		//Not yet started, or on its way out; it'll be back in the queue when
+		//that changes.
+		return nil
+	}
+	lastActivity, err := c.lastActivity(pod)
+	if err != nil {
+		return fmt.Errorf("failed to find when %s was last used: %v", pod.ObjectMeta.Name, err)
+	}
+	idle := c.now().Sub(lastActivity)
+	if idle < c.idle {
+		c.queue.AddAfter(key, c.idle-idle)
+		return nil
+	}
+	return c.cull(pod, idle)
+}
+
+// handleErr retries failed syncs a few times, and after that checks again
+// once every idle period, as a pod may not change for a long time.
+func (c *culler) handleErr(err error, key interface{}) {
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+	if c.queue.NumRequeues(key) < 5 {
+		log.Printf("Error checking %v: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+	c.queue.Forget(key)
+	utilruntime.HandleError(err)
+	log.Printf("Failed to check %v, trying again in %s: %v", key, c.idle, err)
+	c.queue.AddAfter(key, c.idle)
+}
+
+// run runs the culler until stopCh is closed.
+func (c *culler) run(threadiness int, stopCh chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+	log.Printf("Culling notebooks idle for more than %s", c.idle)
+
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
+		return
+	}
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+	log.Print("Stopped culling notebooks")
+}
+
+func (c *culler) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+// podReady reports whether the pod is Ready.
+func podReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// readySince returns when the pod last became Ready.
+func readySince(pod *v1.Pod) time.Time {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// lastActivity returns when the notebook was last used: the pod's
+// last-activity annotation if it has one, otherwise what the notebook
+// server's status endpoint says. Notebooks whose token the culler doesn't
+// know, such as those started with -token-source=log, can't be asked, so
+// are taken to have last been used when they became ready.
+func (c *culler) lastActivity(pod *v1.Pod) (time.Time, error) {
+	if annotation, ok := pod.ObjectMeta.Annotations[lastActivityAnnotation]; ok {
+		return time.Parse(time.RFC3339, annotation)
+	}
+	if pod.Status.PodIP == "" {
+		return time.Time{}, fmt.Errorf("pod has no IP")
+	}
+	status := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(c.port)),
+		Path:   "/api/status",
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == "JUPYTER_TOKEN" {
+				status.RawQuery = url.Values{"token": {env.Value}}.Encode()
+			}
+		}
+	}
+	if status.RawQuery == "" {
+		return readySince(pod), nil
+	}
+	resp, err := c.client.Get(status.String())
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden {
+		//The token isn't the one the notebook uses
+		return readySince(pod), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("%s from the notebook's status endpoint", resp.Status)
+	}
+	var body struct {
+		LastActivity time.Time `json:"last_activity"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return time.Time{}, fmt.Errorf("bad response from the notebook's status endpoint: %v", err)
+	}
+	return body.LastActivity, nil
+}
+
+// owningDeployment returns the deployment the pod is part of, or nil if it's
+// a bare pod.
+func (c *culler) owningDeployment(pod *v1.Pod) (*appsv1.Deployment, error) {
+	rsRef := metav1.GetControllerOf(pod)
+	if rsRef == nil || rsRef.Kind != "ReplicaSet" {
+		return nil, nil
+	}
+	rs, err := c.clientset.AppsV1().ReplicaSets(pod.ObjectMeta.Namespace).Get(rsRef.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deploymentRef := metav1.GetControllerOf(rs)
+	if deploymentRef == nil || deploymentRef.Kind != "Deployment" {
+		return nil, nil
+	}
+	deployment, err := c.clientset.AppsV1().Deployments(pod.ObjectMeta.Namespace).Get(deploymentRef.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return deployment, err
+}
+
+// cull scales down or deletes the idle notebook, recording an Event about it
+// first.
+func (c *culler) cull(pod *v1.Pod, idle time.Duration) error {
+	deployment, err := c.owningDeployment(pod)
+	if err != nil {
+		return err
+	}
+	var what string
+	involved := v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  pod.ObjectMeta.Namespace,
+		Name:       pod.ObjectMeta.Name,
+		UID:        pod.ObjectMeta.UID,
+	}
+	switch {
+	case deployment != nil && c.action == cullScale:
+		what = fmt.Sprintf("scaling deployment %s down to 0", deployment.ObjectMeta.Name)
+	case deployment != nil:
+		what = fmt.Sprintf("deleting deployment %s", deployment.ObjectMeta.Name)
+	default:
+		what = fmt.Sprintf("deleting pod %s", pod.ObjectMeta.Name)
+	}
+	if deployment != nil {
+		involved = v1.ObjectReference{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+			Namespace:  deployment.ObjectMeta.Namespace,
+			Name:       deployment.ObjectMeta.Name,
+			UID:        deployment.ObjectMeta.UID,
+		}
+	}
+	message := fmt.Sprintf("Notebook idle for %s, more than %s; %s", idle.Round(time.Second), c.idle, what)
+	if err := c.recordEvent(involved, message); err != nil {
+		return err
+	}
+	log.Print(message)
+
+	switch {
+	case deployment != nil && c.action == cullScale:
+		err = stopDeployment(c.clientset, deployment.ObjectMeta.Namespace, deployment.ObjectMeta.Name)
+	case deployment != nil:
+		err = c.clientset.AppsV1().Deployments(deployment.ObjectMeta.Namespace).Delete(deployment.ObjectMeta.Name, &metav1.DeleteOptions{})
+	default:
+		err = c.clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Delete(pod.ObjectMeta.Name, &metav1.DeleteOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// recordEvent records a Normal "Culled" Event about the object.
+func (c *culler) recordEvent(involved v1.ObjectReference, message string) error {
+	now := metav1.NewTime(c.now())
+	_, err := c.clientset.CoreV1().Events(involved.Namespace).Create(&v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: involved.Name + ".",
+			Namespace:    involved.Namespace,
+		},
+		InvolvedObject: involved,
+		Reason:         "Culled",
+		Message:        message,
+		Source:         v1.EventSource{Component: "jupyter-culler"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           v1.EventTypeNormal,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record event: %v", err)
+	}
+	return nil
+}
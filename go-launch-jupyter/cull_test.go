@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/theobarberbany/learning-client-go/apply/applytest"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// notebookPod returns a ready notebook pod controlled by owner, if it's not
+// nil.
+func notebookPod(namespace, name string, owner metav1.Object, ownerKind string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "jupyter"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name: "jupyter",
+				Env:  []v1.EnvVar{{Name: "JUPYTER_TOKEN", Value: "secret"}},
+			}},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+	if owner != nil {
+		pod.ObjectMeta.OwnerReferences = []metav1.OwnerReference{controllerRef(owner, ownerKind)}
+	}
+	return pod
+}
+
+func controllerRef(owner metav1.Object, kind string) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: "apps/v1",
+		Kind:       kind,
+		Name:       owner.GetName(),
+		UID:        owner.GetUID(),
+		Controller: &controller,
+	}
+}
+
+func TestCullerScalesDeployment(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	clientset := applytest.NewFakeClientset(nil)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "jupyter-alice", Namespace: "team", UID: types.UID("d1")},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "jupyter-alice-5d8f", Namespace: "team", UID: types.UID("rs1")},
+	}
+	rs.ObjectMeta.OwnerReferences = []metav1.OwnerReference{controllerRef(deployment, "Deployment")}
+	_, err := clientset.AppsV1().Deployments("team").Create(deployment)
+	assert.NoError(t, err)
+	_, err = clientset.AppsV1().ReplicaSets("team").Create(rs)
+	assert.NoError(t, err)
+
+	c := newCuller(clientset, "team", time.Hour, cullScale)
+	c.now = func() time.Time { return now }
+	busy := notebookPod("team", "jupyter-alice-5d8f-busy", rs, "ReplicaSet")
+	busy.ObjectMeta.Annotations = map[string]string{lastActivityAnnotation: now.Add(-30 * time.Minute).Format(time.RFC3339)}
+	assert.NoError(t, c.indexer.Add(busy))
+	assert.NoError(t, c.sync("team/jupyter-alice-5d8f-busy"))
+	deployment, err = clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), *deployment.Spec.Replicas)
+
+	idle := notebookPod("team", "jupyter-alice-5d8f-idle", rs, "ReplicaSet")
+	idle.ObjectMeta.Annotations = map[string]string{lastActivityAnnotation: now.Add(-90 * time.Minute).Format(time.RFC3339)}
+	assert.NoError(t, c.indexer.Add(idle))
+	assert.NoError(t, c.sync("team/jupyter-alice-5d8f-idle"))
+	deployment, err = clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+	events, err := clientset.CoreV1().Events("team").List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, events.Items, 1) {
+		event := events.Items[0]
+		assert.Equal(t, "Culled", event.Reason)
+		assert.Equal(t, "Deployment", event.InvolvedObject.Kind)
+		assert.Equal(t, "jupyter-alice", event.InvolvedObject.Name)
+		assert.Equal(t, "Notebook idle for 1h30m0s, more than 1h0m0s; scaling deployment jupyter-alice down to 0", event.Message)
+	}
+}
+
+func TestCullerDeletesBarePod(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" || r.URL.Query().Get("token") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"started": "2018-03-01T08:00:00Z", "last_activity": %q}`, now.Add(-3*time.Hour).Format(time.RFC3339))
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.NoError(t, err)
+
+	clientset := applytest.NewFakeClientset(nil)
+	pod := notebookPod("default", "jupyter", nil, "")
+	pod.Status.PodIP = "127.0.0.1"
+	_, err = clientset.CoreV1().Pods("default").Create(pod)
+	assert.NoError(t, err)
+
+	c := newCuller(clientset, "default", 2*time.Hour, cullDelete)
+	c.now = func() time.Time { return now }
+	c.port, err = strconv.Atoi(port)
+	assert.NoError(t, err)
+
+	//Not ready pods are left alone
+	starting := pod.DeepCopy()
+	starting.Status.Conditions[0].Status = v1.ConditionFalse
+	assert.NoError(t, c.indexer.Add(starting))
+	assert.NoError(t, c.sync("default/jupyter"))
+	_, err = clientset.CoreV1().Pods("default").Get("jupyter", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.indexer.Update(pod))
+	assert.NoError(t, c.sync("default/jupyter"))
+	_, err = clientset.CoreV1().Pods("default").Get("jupyter", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	events, err := clientset.CoreV1().Events("default").List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, events.Items, 1) {
+		assert.Equal(t, "Pod", events.Items[0].InvolvedObject.Kind)
+		assert.Equal(t, "Notebook idle for 3h0m0s, more than 2h0m0s; deleting pod jupyter", events.Items[0].Message)
+	}
+
+}
+
+func TestCullerUsesReadyTime(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	clientset := applytest.NewFakeClientset(nil)
+	pod := notebookPod("default", "jupyter", nil, "")
+	pod.Status.PodIP = "127.0.0.1"
+	_, err := clientset.CoreV1().Pods("default").Create(pod)
+	assert.NoError(t, err)
+	c := newCuller(clientset, "default", 2*time.Hour, cullDelete)
+	c.now = func() time.Time { return now }
+
+	//A notebook whose token isn't known can't say when it was last used, so
+	//is culled once it's been ready for longer than the idle period
+	pod.Spec.Containers[0].Env = nil
+	pod.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-time.Hour))
+	assert.NoError(t, c.indexer.Add(pod))
+	assert.NoError(t, c.sync("default/jupyter"))
+	_, err = clientset.CoreV1().Pods("default").Get("jupyter", metav1.GetOptions{})
+	assert.NoError(t, err)
+	pod.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-3 * time.Hour))
+	assert.NoError(t, c.indexer.Update(pod))
+	assert.NoError(t, c.sync("default/jupyter"))
+	_, err = clientset.CoreV1().Pods("default").Get("jupyter", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCullSelector(t *testing.T) {
+	//Pods of controller_launch_jupyter's Notebooks aren't watched
+	launched := notebookPod("team", "jupyter-alice", nil, "")
+	controlled := notebookPod("team", "python-client-1", nil, "")
+	controlled.ObjectMeta.Labels["notebook"] = "python-client"
+	clientset := applytest.NewFakeClientset(nil, launched, controlled)
+	pods, err := clientset.CoreV1().Pods("team").List(metav1.ListOptions{LabelSelector: cullSelector})
+	assert.NoError(t, err)
+	if assert.Len(t, pods.Items, 1) {
+		assert.Equal(t, "jupyter-alice", pods.Items[0].ObjectMeta.Name)
+	}
+}
+
+func TestCullerKeepsChecking(t *testing.T) {
+	c := newCuller(applytest.NewFakeClientset(nil), "default", 10*time.Millisecond, cullScale)
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour))
+	defer c.queue.ShutDown()
+
+	//After a few quick retries, a pod that can't be checked is checked again
+	//every idle period rather than forgotten
+	for i := 0; i < 5; i++ {
+		c.handleErr(fmt.Errorf("connection refused"), "default/jupyter")
+	}
+	assert.Equal(t, 0, c.queue.Len())
+	c.handleErr(fmt.Errorf("connection refused"), "default/jupyter")
+	assert.Equal(t, 0, c.queue.NumRequeues("default/jupyter"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, c.queue.Len())
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/theobarberbany/learning-client-go/apply"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	intstr "k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// homeVolume is the name of the volume with the user's home directory.
+const homeVolume = "home"
+
+// defaultProfile is the profile notebooks get if they don't ask for one.
+const defaultProfile = "small"
+
+// profiles are the sizes of notebook server there are to choose from.
+var profiles = map[string]v1.ResourceRequirements{
+	"small": {
+		Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("500m"),
+			v1.ResourceMemory: resource.MustParse("1Gi"),
+		},
+		Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("1"),
+			v1.ResourceMemory: resource.MustParse("2Gi"),
+		},
+	},
+	"medium": {
+		Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("2"),
+			v1.ResourceMemory: resource.MustParse("4Gi"),
+		},
+		Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("4"),
+			v1.ResourceMemory: resource.MustParse("8Gi"),
+		},
+	},
+	"large": {
+		Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("4"),
+			v1.ResourceMemory: resource.MustParse("16Gi"),
+		},
+		Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("8"),
+			v1.ResourceMemory: resource.MustParse("32Gi"),
+		},
+	},
+}
+
+// profileNames returns the names of the profiles, smallest first.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := profiles[names[i]].Requests[v1.ResourceMemory], profiles[names[j]].Requests[v1.ResourceMemory]
+		return a.Cmp(b) < 0
+	})
+	return names
+}
+
+// checkProfile returns an error if there's no profile by the name.
+func checkProfile(profile string) error {
+	if _, ok := profiles[profile]; !ok {
+		return fmt.Errorf("unknown profile %q, must be one of %s", profile, strings.Join(profileNames(), ", "))
+	}
+	return nil
+}
+
+// notebook describes a user's notebook server.
+type notebook struct {
+	Namespace string
+	User      string
+	Image     string
+	// Profile names the resources the notebook server gets from profiles.
+	Profile string
+	Git     gitSource
+	// Token is given to the notebook in $JUPYTER_TOKEN; if it's "" the
+	// notebook makes its own and logs it.
+	Token string
+	// Storage is the size of the claim for the home directory, and
+	// StorageClass its class ("" for the cluster's default).
+	Storage      resource.Quantity
+	StorageClass string
+}
+
+// userName checks a user name can be used in the names and labels of the
+// user's objects, lower casing it.
+func userName(user string) (string, error) {
+	user = strings.ToLower(user)
+	if errs := validation.IsDNS1123Label(user); len(errs) > 0 {
+		return "", fmt.Errorf("can't use %q as a user name: %s", user, strings.Join(errs, ", "))
+	}
+	return user, nil
+}
+
+// name is the name of the user's deployment and service.
+func (n *notebook) name() string {
+	return "jupyter-" + n.User
+}
+
+// claimName is the name of the claim for the user's home directory.
+func (n *notebook) claimName() string {
+	return n.name() + "-home"
+}
+
+// labels are put on all the user's objects and pods.
+func (n *notebook) labels() map[string]string {
+	return map[string]string{
+		"app":  "jupyter",
+		"user": n.User,
+	}
+}
+
+// deploymentLabels are put on the user's deployment and its pods, saying
+// what it was launched with.
+func (n *notebook) deploymentLabels() map[string]string {
+	set := n.labels()
+	set["profile"] = n.Profile
+	return set
+}
+
+// selector selects the user's notebook pods.
+func (n *notebook) selector() string {
+	return labels.SelectorFromSet(n.labels()).String()
+}
+
+// claim is the claim for the user's home directory, which outlives the
+// deployment.
+func (n *notebook) claim() *v1.PersistentVolumeClaim {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      n.claimName(),
+			Namespace: n.Namespace,
+			Labels:    n.labels(),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: n.Storage,
+				},
+			},
+		},
+	}
+	if n.StorageClass != "" {
+		claim.Spec.StorageClassName = &n.StorageClass
+	}
+	return claim
+}
+
+// deployment runs a single notebook server with the claim as its home
+// directory.
+func (n *notebook) deployment() *appsv1.Deployment {
+	replicas := int32(1)
+	var env []v1.EnvVar
+	if n.Token != "" {
+		env = []v1.EnvVar{{Name: "JUPYTER_TOKEN", Value: n.Token}}
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      n.name(),
+			Namespace: n.Namespace,
+			Labels:    n.deploymentLabels(),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: n.labels(),
+			},
+			//The claim can only be mounted on one node, so the old pod has
+			//to go before the new one can start.
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: n.deploymentLabels(),
+				},
+				Spec: v1.PodSpec{
+					Volumes: append([]v1.Volume{
+						{
+							Name: homeVolume,
+							VolumeSource: v1.VolumeSource{
+								PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+									ClaimName: n.claimName(),
+								},
+							},
+						},
+					}, n.Git.volumes()...),
+					//Clone the notebooks before the notebook server starts
+					InitContainers: []v1.Container{n.Git.initContainer(homeVolume)},
+					Containers: []v1.Container{
+						{
+							Name:      "jupyter",
+							Image:     n.Image,
+							Env:       env,
+							Resources: profiles[n.Profile],
+							VolumeMounts: []v1.VolumeMount{
+								{
+									Name:      homeVolume,
+									MountPath: "/root",
+								},
+							},
+							Ports: []v1.ContainerPort{
+								{
+									Name:          "http",
+									Protocol:      v1.ProtocolTCP,
+									ContainerPort: notebookPort,
+								},
+							},
+							//Ready once the notebook server is listening
+							ReadinessProbe: &v1.Probe{
+								Handler: v1.Handler{
+									TCPSocket: &v1.TCPSocketAction{
+										Port: intstr.FromString("http"),
+									},
+								},
+								PeriodSeconds: 2,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// service exposes the notebook outside the cluster.
+func (n *notebook) service() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      n.name(),
+			Namespace: n.Namespace,
+			Labels:    n.labels(),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeLoadBalancer,
+			Selector: n.labels(),
+			Ports: []v1.ServicePort{
+				{
+					Port:       80,
+					Name:       "http",
+					TargetPort: intstr.FromInt(notebookPort),
+				},
+			},
+		},
+	}
+}
+
+// existingToken returns the token the user's notebook was last launched with,
+// or "" if it hasn't been launched or made its own token.
+func existingToken(clientset kubernetes.Interface, namespace, user string) (string, error) {
+	n := &notebook{Namespace: namespace, User: user}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(n.name(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return deploymentToken(deployment), nil
+}
+
+// deploymentToken returns the token the deployment gives its notebook, or ""
+// if the notebook makes its own.
+func deploymentToken(deployment *appsv1.Deployment) string {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == "JUPYTER_TOKEN" {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// launchToken returns the token to launch the user's notebook with: the one
+// it was launched with before, so as not to restart it just to change the
+// token, or otherwise a new one.
+func launchToken(clientset kubernetes.Interface, namespace, user string) (string, error) {
+	token, err := existingToken(clientset, namespace, user)
+	if err != nil || token != "" {
+		return token, err
+	}
+	return generateToken()
+}
+
+// launch creates the user's notebook, or updates it and scales it back up if
+// it was launched before, reusing the claim for the home directory. It
+// reports what it did to each object to out.
+func launch(clientset kubernetes.Interface, n *notebook, out io.Writer) (*v1.Service, error) {
+	claim, result, err := apply.PersistentVolumeClaim(clientset, n.claim())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Claim %s %s\n", claim.ObjectMeta.Name, result)
+	deployment, result, err := apply.Deployment(clientset, n.deployment())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Deployment %s %s\n", deployment.ObjectMeta.Name, result)
+	svc, result, err := apply.Service(clientset, n.service())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "Service %s %s\n", svc.ObjectMeta.Name, result)
+	return svc, nil
+}
+
+// stop scales the user's notebook down to nothing, keeping its claim and
+// service so it can be started again where it left off.
+func stop(clientset kubernetes.Interface, namespace, user string) error {
+	n := &notebook{Namespace: namespace, User: user}
+	err := stopDeployment(clientset, namespace, n.name())
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%s has no notebook in %s", user, namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stop notebook %s: %v", n.name(), err)
+	}
+	return nil
+}
+
+// stopDeployment scales the deployment down to nothing.
+func stopDeployment(clientset kubernetes.Interface, namespace, name string) error {
+	_, err := clientset.AppsV1().Deployments(namespace).Patch(name, types.MergePatchType, []byte(`{"spec":{"replicas":0}}`))
+	return err
+}
@@ -1,21 +1,21 @@
-// Modified, using code from 
+// Modified, using code from
 //https://github.com/kubernetes/client-go/tree/master/examples/out-of-cluster-client-configuration
-//as a base, and attempting to recreate running 'kubectl create -f' on 
+//as a base, and attempting to recreate running 'kubectl create -f' on
 //https://raw.githubusercontent.com/kubernetes-incubator/client-python/master/examples/notebooks/docker/jupyter.yml
 package main
 
 import (
-        "fmt"
-        //"time"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
-        "k8s.io/api/core/v1"
-        metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-        intstr "k8s.io/apimachinery/pkg/util/intstr"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
-        "k8s.io/client-go/util/retry"
 	// Uncomment the following line to load the gcp plugin (only required to authenticate against GKE clusters).
 	// _ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
@@ -27,7 +27,65 @@ func main() {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
+	tokenSource := flag.String("token-source", tokenFromEnv, "How to get the notebook token: env (generate one and give it to the notebook in $JUPYTER_TOKEN) or log (read the one the notebook prints)")
+	readyTimeout := flag.Duration("ready-timeout", 5*time.Minute, "How long to wait for the notebook to be ready")
+	lbTimeout := flag.Duration("lb-timeout", time.Minute, "How long to wait for the LoadBalancer to get an address before trying the NodePort")
+	localPort := flag.Int("local-port", 8888, "Local port to forward to the notebook if it can't be reached any other way")
+	var git gitSource
+	flag.StringVar(&git.Repo, "repo", "https://github.com/kubernetes-client/python.git", "Git repository of notebooks to clone in to the home directory")
+	flag.StringVar(&git.Ref, "ref", "", "Branch, tag or commit of the repository to check out (defaults to the default branch)")
+	flag.IntVar(&git.Depth, "depth", 1, "Number of commits of history to clone, or 0 for all of it")
+	flag.StringVar(&git.Secret, "git-secret", "", "Secret with an ssh-privatekey and known_hosts, or a token (and optionally username), to clone a private repository with")
+	flag.StringVar(&git.Image, "git-image", "alpine/git", "Image to run git in")
+	namespace := flag.String("namespace", "default", "Namespace to run the notebook in")
+	user := flag.String("user", os.Getenv("USER"), "User the notebook is for; each user has their own notebook and home directory")
+	image := flag.String("image", "skippbox/jupyter:0.0.3", "Notebook image")
+	profile := flag.String("profile", defaultProfile, "Size of notebook server: "+strings.Join(profileNames(), ", "))
+	storage := flag.String("storage", "1Gi", "Size of the home directory, when it's first made")
+	storageClass := flag.String("storage-class", "", "Storage class of the home directory (defaults to the cluster's default)")
+	listen := flag.String("listen", ":8080", "Address for serve to listen on")
+	userHeader := flag.String("user-header", "", "Header an authenticating proxy in front of serve sets to the caller's user name (by default callers give a Kubernetes bearer token, checked with a TokenReview)")
+	idle := flag.Duration("idle", time.Hour, "How long a notebook may go unused before cull culls it")
+	cullAction := flag.String("cull-action", cullScale, "What cull does to idle notebooks: scale (down to nothing, keeping their data) or delete (their deployments)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [start|stop|serve|cull]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "start (the default) launches your notebook, or starts it again where it left off.")
+		fmt.Fprintln(os.Stderr, "stop scales it down to nothing, keeping your home directory.")
+		fmt.Fprintln(os.Stderr, "serve runs an HTTP service launching, listing and stopping notebooks for everyone.")
+		fmt.Fprint(os.Stderr, "cull runs a controller that culls notebooks that haven't been used for a while.\n\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	command := "start"
+	if flag.NArg() == 1 {
+		command = flag.Arg(0)
+	}
+	if flag.NArg() > 1 || (command != "start" && command != "stop" && command != "serve" && command != "cull") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *tokenSource != tokenFromEnv && *tokenSource != tokenFromLog {
+		fmt.Fprintf(os.Stderr, "-token-source must be %s or %s\n", tokenFromEnv, tokenFromLog)
+		os.Exit(2)
+	}
+	if *cullAction != cullScale && *cullAction != cullDelete {
+		fmt.Fprintf(os.Stderr, "-cull-action must be %s or %s\n", cullScale, cullDelete)
+		os.Exit(2)
+	}
+	owner, err := userName(*user)
+	if err != nil && (command == "start" || command == "stop") {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := checkProfile(*profile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	size, err := resource.ParseQuantity(*storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad -storage: %v\n", err)
+		os.Exit(2)
+	}
 
 	// use the current context in kubeconfig
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
@@ -40,102 +98,106 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
-        namespace := "default"
-        pod_name := "jupyter"
-        //Create a notebook pod.
-        _, err = clientset.CoreV1().Pods(namespace).Create(&v1.Pod{
-                ObjectMeta: metav1.ObjectMeta{
-                        Name: pod_name,
-                },
-                Spec: v1.PodSpec{
-                        Volumes: []v1.Volume{
-                                {
-                                        Name: "notebook-volume",
-                                        VolumeSource: v1.VolumeSource{
-                                                GitRepo: &v1.GitRepoVolumeSource{
-                                                        Repository: "https://github.com/kubernetes-client/python.git",
-                                                },
-                                        },
-                                },
-                        },
-                        Containers: []v1.Container {
-                                {
-                                        Name: "jupyter",
-                                        Image: "skippbox/jupyter:0.0.3",
-                                        VolumeMounts: []v1.VolumeMount{
-                                                {
-                                                        Name: "notebook-volume",
-                                                        MountPath: "/root",
-                                                },
-                                        },
-                                        Ports: []v1.ContainerPort{
-                                                {
-                                                        Name: "http",
-                                                        Protocol: v1.ProtocolTCP,
-                                                        ContainerPort :8888,
-                                                },
-                                        },
-                                },
-                        },
-                },
-        })
-        if err != nil {
-                panic(err.Error())
-        }
-        //Get latest version of the pod
-        retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-                //should avoid conflicts
-                //exponential backoff
-                result, getErr := clientset.CoreV1().Pods(namespace).Get(pod_name, metav1.GetOptions{})
-                //Panic if getting pod fails
-                if getErr != nil {
-                        panic(fmt.Errorf("Failed to get latest version of pod: %v", getErr))
-                }
-                //set labels for pod
-                result.ObjectMeta.SetLabels(map[string]string{
-                        "app": "jupyter",
-                })
-                //update the pod, and return the updated pod or error
-                _, updateErr := clientset.CoreV1().Pods(namespace).Update(result)
-                return updateErr
-        })
-        if retryErr != nil {
-                panic(fmt.Errorf("Update failed: %v", retryErr))
-        }
-        pod, getErr := clientset.CoreV1().Pods(namespace).Get(pod_name, metav1.GetOptions{})
-        //Panic if getting pod fails
-        if getErr != nil {
-                panic(fmt.Errorf("Failed to get latest version of pod: %v", getErr))
-        }
-        fmt.Println("Updated Labels on pod")
-        //add a service to expose the pod
-        svc, err := clientset.CoreV1().Services(namespace).Create(&v1.Service{
-                ObjectMeta: metav1.ObjectMeta{
-                        Name: "jupyter-svc",
-                        Labels: map[string]string{
-                                "app": "jupyter",
-                        },
-                },
-                Spec: v1.ServiceSpec{
-                        Type: v1.ServiceTypeLoadBalancer,
-                        Selector: pod.Labels,
-                        Ports: []v1.ServicePort{
-                                        {
-                                        Port: 80,
-                                        Name: "http",
-                                        TargetPort: intstr.IntOrString{
-                                                IntVal: 8888,
-                                        },
-                                },
-                        },
-                },
-        })
-        if err != nil {
-                fmt.Println(err)
-                panic(err)
-        }
-        fmt.Println(svc.Spec.Ports[0].NodePort)
-        fmt.Println("Hopefully everything's done now")
+	if command == "stop" {
+		if err := stop(clientset, *namespace, owner); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Stopped %s's notebook; their home directory is kept for next time\n", owner)
+		return
+	}
+
+	if command == "cull" {
+		stopCulling := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			close(stopCulling)
+		}()
+		newCuller(clientset, *namespace, *idle, *cullAction).run(1, stopCulling)
+		return
+	}
+	if command == "serve" {
+		s := &spawner{
+			clientset:    clientset,
+			namespace:    *namespace,
+			image:        *image,
+			git:          git,
+			storage:      size,
+			storageClass: *storageClass,
+			userHeader:   *userHeader,
+		}
+		if err := s.serve(*listen); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if err := git.validate(clientset, *namespace); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	nb := &notebook{
+		Namespace:    *namespace,
+		User:         owner,
+		Image:        *image,
+		Profile:      *profile,
+		Git:          git,
+		Storage:      size,
+		StorageClass: *storageClass,
+	}
+	if *tokenSource == tokenFromEnv {
+		nb.Token, err = launchToken(clientset, *namespace, owner)
+		if err != nil {
+			panic(err)
+		}
+	}
+	svc, err := launch(clientset, nb, os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Service %s has NodePort %d\n", svc.ObjectMeta.Name, svc.Spec.Ports[0].NodePort)
+
+	//Wait for the notebook to come up, and find out how to get to it
+	fmt.Println("Waiting for the notebook to be ready...")
+	pod, err := waitReady(clientset, *namespace, nb.selector(), *readyTimeout)
+	if err != nil {
+		panic(err)
+	}
+	token := nb.Token
+	if token == "" {
+		token, err = tokenFromLogs(clientset, *namespace, pod.ObjectMeta.Name, "jupyter", *readyTimeout)
+		if err != nil {
+			panic(err)
+		}
+	}
+	address, err := externalAddress(clientset, svc, pod, *lbTimeout)
+	if err != nil {
+		panic(err)
+	}
+	if address != "" {
+		fmt.Printf("Notebook is ready at %s\n", notebookURL(address, token))
+		return
+	}
+
+	//Nothing outside the cluster can reach it, so forward a local port to
+	//the pod until we're interrupted.
+	fmt.Println("The notebook isn't reachable from here, forwarding a local port to it (Ctrl-C to stop)")
+	stopForward := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stopForward)
+	}()
+	ready := make(chan struct{})
+	go func() {
+		<-ready
+		fmt.Printf("Notebook is ready at %s\n", notebookURL(fmt.Sprintf("localhost:%d", *localPort), token))
+	}()
+	if err := portForward(config, pod, *localPort, stopForward, ready); err != nil {
+		panic(err)
+	}
 }
 
 func homeDir() string {
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Where the notebook's token comes from.
+const (
+	tokenFromEnv = "env"
+	tokenFromLog = "log"
+)
+
+// notebookPort is the port the notebook server listens on in the container.
+const notebookPort = 8888
+
+// tokenPattern finds the token in the URL the notebook logs when it starts.
+var tokenPattern = regexp.MustCompile(`[?&]token=([0-9a-zA-Z]+)`)
+
+// generateToken makes a random token to give the notebook.
+func generateToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate a token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newestPod returns the most recently created of the pods matching the
+// selector that isn't being deleted, or nil if there isn't one.
+func newestPod(clientset kubernetes.Interface, namespace, selector string) (*v1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var newest *v1.Pod
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		if newest == nil || newest.ObjectMeta.CreationTimestamp.Before(&pod.ObjectMeta.CreationTimestamp) {
+			newest = pod
+		}
+	}
+	return newest, nil
+}
+
+// waitReady waits for the newest pod matching the selector to be Ready,
+// giving up early if it can't start or its notebooks couldn't be cloned.
+func waitReady(clientset kubernetes.Interface, namespace, selector string, timeout time.Duration) (*v1.Pod, error) {
+	var pod *v1.Pod
+	err := wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		var err error
+		pod, err = newestPod(clientset, namespace, selector)
+		if err != nil || pod == nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, fmt.Errorf("pod %s stopped: %s %s", pod.ObjectMeta.Name, pod.Status.Phase, pod.Status.Message)
+		}
+		if err := initContainerFailure(clientset, pod); err != nil {
+			return false, err
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if waiting := status.State.Waiting; waiting != nil {
+				switch waiting.Reason {
+				case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CrashLoopBackOff", "CreateContainerConfigError":
+					return false, fmt.Errorf("container %s can't start: %s %s", status.Name, waiting.Reason, waiting.Message)
+				}
+			}
+		}
+		return podReady(pod), nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, fmt.Errorf("the notebook wasn't ready after %s", timeout)
+	}
+	return pod, err
+}
+
+// tokenFromLogs reads the token from the URL the notebook prints when it
+// starts, waiting for it to appear.
+func tokenFromLogs(clientset kubernetes.Interface, namespace, name, container string, timeout time.Duration) (string, error) {
+	var token string
+	err := wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		logs, err := clientset.CoreV1().Pods(namespace).GetLogs(name, &v1.PodLogOptions{Container: container}).Stream()
+		if err != nil {
+			return false, err
+		}
+		defer logs.Close()
+		scanner := bufio.NewScanner(logs)
+		for scanner.Scan() {
+			if match := tokenPattern.FindStringSubmatch(scanner.Text()); match != nil {
+				token = match[1]
+				return true, nil
+			}
+		}
+		return false, scanner.Err()
+	})
+	if err == wait.ErrWaitTimeout {
+		return "", fmt.Errorf("the notebook didn't log its token within %s", timeout)
+	}
+	return token, err
+}
+
+// externalAddress works out a host:port the notebook can be reached on from
+// here: the LoadBalancer's ingress once it has one, or otherwise the NodePort
+// on the address of the node the pod is on. It returns "" if neither works.
+func externalAddress(clientset kubernetes.Interface, svc *v1.Service, pod *v1.Pod, lbTimeout time.Duration) (string, error) {
+	var address string
+	err := wait.PollImmediate(2*time.Second, lbTimeout, func() (bool, error) {
+		current, err := clientset.CoreV1().Services(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		address = ingressAddress(current)
+		return address != "", nil
+	})
+	if err == nil {
+		return address, nil
+	}
+	if err != wait.ErrWaitTimeout {
+		return "", err
+	}
+
+	fmt.Printf("LoadBalancer has no address after %s, trying the NodePort\n", lbTimeout)
+	node, err := clientset.CoreV1().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %v", pod.Spec.NodeName, err)
+	}
+	nodePort := strconv.Itoa(int(svc.Spec.Ports[0].NodePort))
+	for _, addressType := range []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP} {
+		for _, nodeAddress := range node.Status.Addresses {
+			if nodeAddress.Type != addressType {
+				continue
+			}
+			address = net.JoinHostPort(nodeAddress.Address, nodePort)
+			conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			return address, nil
+		}
+	}
+	return "", nil
+}
+
+// ingressAddress returns the host:port of the service's LoadBalancer, or ""
+// if it doesn't have one yet.
+func ingressAddress(svc *v1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		host := ingress.IP
+		if host == "" {
+			host = ingress.Hostname
+		}
+		if host != "" {
+			return net.JoinHostPort(host, strconv.Itoa(int(svc.Spec.Ports[0].Port)))
+		}
+	}
+	return ""
+}
+
+// notebookURL is the URL to open the notebook at address, logged in with
+// token.
+func notebookURL(address, token string) string {
+	return fmt.Sprintf("http://%s/?token=%s", address, token)
+}
+
+// portForward forwards localPort to the notebook in the pod until stop is
+// closed. ready is closed once the port is being forwarded.
+func portForward(config *rest.Config, pod *v1.Pod, localPort int, stop <-chan struct{}, ready chan struct{}) error {
+	roundTripper, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	url := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.ObjectMeta.Namespace).
+		Name(pod.ObjectMeta.Name).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, "POST", url)
+	ports := []string{fmt.Sprintf("%d:%d", localPort, notebookPort)}
+	forwarder, err := portforward.New(dialer, ports, stop, ready, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	return forwarder.ForwardPorts()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWaitReady(t *testing.T) {
+	older := notebookPod("team", "nb-1", nil, "")
+	older.ObjectMeta.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	deleting := notebookPod("team", "nb-3", nil, "")
+	deleting.ObjectMeta.CreationTimestamp = metav1.Now()
+	deleting.ObjectMeta.DeletionTimestamp = &deleting.ObjectMeta.CreationTimestamp
+	newer := notebookPod("team", "nb-2", nil, "")
+	newer.ObjectMeta.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute))
+	newer.Status.Conditions[0].Status = v1.ConditionFalse
+
+	//The newest pod not being deleted is waited for until it's ready
+	clientset := fake.NewSimpleClientset(older, newer, deleting)
+	lists := 0
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists++
+		if lists < 2 {
+			return false, nil, nil
+		}
+		ready := newer.DeepCopy()
+		ready.Status.Conditions[0].Status = v1.ConditionTrue
+		return true, &v1.PodList{Items: []v1.Pod{*older, *ready, *deleting}}, nil
+	})
+	pod, err := waitReady(clientset, "team", "app=jupyter", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "nb-2", pod.ObjectMeta.Name)
+	assert.Equal(t, 2, lists)
+
+	//No pod, or one that never gets ready, times out
+	_, err = waitReady(fake.NewSimpleClientset(), "team", "app=jupyter", 10*time.Millisecond)
+	assert.EqualError(t, err, "the notebook wasn't ready after 10ms")
+	_, err = waitReady(fake.NewSimpleClientset(newer), "team", "app=jupyter", 10*time.Millisecond)
+	assert.EqualError(t, err, "the notebook wasn't ready after 10ms")
+
+	//A pod that can't start is given up on straight away
+	newer.Status.ContainerStatuses = []v1.ContainerStatus{{
+		Name:  "jupyter",
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+	}}
+	_, err = waitReady(fake.NewSimpleClientset(newer), "team", "app=jupyter", time.Minute)
+	assert.EqualError(t, err, "container jupyter can't start: ImagePullBackOff Back-off pulling image")
+	newer.Status = v1.PodStatus{Phase: v1.PodFailed, Message: "Evicted"}
+	_, err = waitReady(fake.NewSimpleClientset(newer), "team", "app=jupyter", time.Minute)
+	assert.EqualError(t, err, "pod nb-2 stopped: Failed Evicted")
+}
+
+func TestNotebookAddress(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "nb", Namespace: "team"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}},
+	}
+	assert.Empty(t, ingressAddress(svc))
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{Hostname: "nb.example.com"}}
+	assert.Equal(t, "nb.example.com:80", ingressAddress(svc))
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.1", Hostname: "nb.example.com"}}
+	assert.Equal(t, "10.0.0.1:80", ingressAddress(svc))
+	address, err := externalAddress(fake.NewSimpleClientset(svc), svc, nil, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:80", address)
+
+	//Without a LoadBalancer the NodePort is tried on the pod's node
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	nodePort, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+	svc.Status.LoadBalancer.Ingress = nil
+	svc.Spec.Ports[0].NodePort = int32(nodePort)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: "node-1"},
+			{Type: v1.NodeInternalIP, Address: "127.0.0.1"},
+		}},
+	}
+	pod := &v1.Pod{Spec: v1.PodSpec{NodeName: "node-1"}}
+	address, err = externalAddress(fake.NewSimpleClientset(svc, node), svc, pod, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, listener.Addr().String(), address)
+}
+
+func TestNotebookURL(t *testing.T) {
+	token, err := generateToken()
+	assert.NoError(t, err)
+	assert.Len(t, token, 48)
+	url := notebookURL("10.0.0.1:80", token)
+	assert.Equal(t, "http://10.0.0.1:80/?token="+token, url)
+	assert.Equal(t, []string{"?token=" + token, token}, tokenPattern.FindStringSubmatch(url))
+
+	//The token is found in the line the notebook logs when it starts
+	match := tokenPattern.FindStringSubmatch("    http://(nb-2 or 127.0.0.1):8888/?token=0123abcd")
+	assert.Equal(t, "0123abcd", match[1])
+}
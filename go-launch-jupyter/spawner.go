@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// spawner is an HTTP service that launches, lists and stops notebooks for a
+// team, one per user, in a namespace:
+//
+//	GET  /notebooks              lists the notebooks
+//	POST /notebooks              launches the caller's notebook, described by the body
+//	GET  /notebooks/USER         shows the user's notebook, with its token if it's the caller's
+//	POST /notebooks/USER/stop    stops the caller's notebook, keeping its data
+//
+// Requests and responses are JSON. Every request must say who is making it:
+// by default with a Kubernetes bearer token, which is checked with a
+// TokenReview (so the spawner needs to be allowed to create them), or, behind
+// an authenticating proxy, in the userHeader the proxy sets. Only a notebook's
+// owner can launch or stop it, or see its token.
+type spawner struct {
+	clientset    kubernetes.Interface
+	namespace    string
+	image        string
+	git          gitSource
+	storage      resource.Quantity
+	storageClass string
+	// userHeader, if set, is the header an authenticating proxy in front of
+	// the spawner puts the caller's user name in. It must only be set if
+	// nothing else can reach the spawner.
+	userHeader string
+}
+
+// launchRequest is the body of a request to launch a notebook. User defaults
+// to the caller, and Profile, Repo and Ref to the spawner's. Repos other than
+// the spawner's are cloned without its git credentials.
+type launchRequest struct {
+	User    string `json:"user"`
+	Profile string `json:"profile"`
+	Repo    string `json:"repo"`
+	Ref     string `json:"ref"`
+}
+
+// notebookStatus describes a user's notebook.
+type notebookStatus struct {
+	User    string `json:"user"`
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+	// Running is whether the notebook should be running, and Ready whether it
+	// is.
+	Running bool `json:"running"`
+	Ready   bool `json:"ready"`
+	// URL is where the notebook can be reached, once its service has an
+	// external address. It includes the token only when a single notebook is
+	// asked about.
+	URL string `json:"url,omitempty"`
+}
+
+// errorResponse is the body of a failed request.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handler returns the spawner's HTTP handler.
+func (s *spawner) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notebooks", s.serveNotebooks)
+	mux.HandleFunc("/notebooks/", s.serveNotebook)
+	return mux
+}
+
+// serve runs the spawner on addr until it fails.
+func (s *spawner) serve(addr string) error {
+	log.Printf("Spawning notebooks in %s, listening on %s", s.namespace, addr)
+	return http.ListenAndServe(addr, s.handler())
+}
+
+func (s *spawner) serveNotebooks(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.list(w)
+	case http.MethodPost:
+		s.launch(w, r, caller)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+func (s *spawner) serveNotebook(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/notebooks/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.show(w, parts[0], caller)
+	case len(parts) == 2 && parts[1] == "stop" && r.Method == http.MethodPost:
+		s.stop(w, parts[0], caller)
+	case len(parts) <= 2:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such resource %s", r.URL.Path))
+	}
+}
+
+// caller returns the name of the user making the request, responding with
+// an error if there isn't one.
+func (s *spawner) caller(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var name string
+	if s.userHeader != "" {
+		name = r.Header.Get(s.userHeader)
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		review, err := s.clientset.AuthenticationV1().TokenReviews().Create(&authv1.TokenReview{
+			Spec: authv1.TokenReviewSpec{Token: strings.TrimPrefix(auth, "Bearer ")},
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to check token: %v", err))
+			return "", false
+		}
+		if review.Status.Authenticated {
+			name = review.Status.User.Username
+		}
+	}
+	if name == "" {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("not authenticated"))
+		return "", false
+	}
+	user, err := userName(name)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return "", false
+	}
+	return user, true
+}
+
+// list responds with the status of every notebook, without their tokens.
+func (s *spawner) list(w http.ResponseWriter) {
+	deployments, err := s.clientset.AppsV1().Deployments(s.namespace).List(metav1.ListOptions{LabelSelector: "app=jupyter"})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses := []notebookStatus{}
+	for i := range deployments.Items {
+		status, err := s.status(&deployments.Items[i], false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].User < statuses[j].User
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// launch launches or starts again the caller's notebook, and responds with
+// its status.
+func (s *spawner) launch(w http.ResponseWriter, r *http.Request, caller string) {
+	var req launchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad request body: %v", err))
+		return
+	}
+	if req.User == "" {
+		req.User = caller
+	}
+	user, err := userName(req.User)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if user != caller {
+		writeError(w, http.StatusForbidden, fmt.Errorf("%s can't launch %s's notebook", caller, user))
+		return
+	}
+	if req.Profile == "" {
+		req.Profile = defaultProfile
+	}
+	if err := checkProfile(req.Profile); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	git := s.git
+	if req.Repo != "" && req.Repo != s.git.Repo {
+		//The credentials are only for the spawner's repo, not wherever the
+		//caller asks
+		git.Repo, git.Ref, git.Secret = req.Repo, req.Ref, ""
+	} else if req.Ref != "" {
+		git.Ref = req.Ref
+	}
+	if err := git.validate(s.clientset, s.namespace); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	token, err := launchToken(s.clientset, s.namespace, user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	nb := &notebook{
+		Namespace:    s.namespace,
+		User:         user,
+		Image:        s.image,
+		Profile:      req.Profile,
+		Git:          git,
+		Token:        token,
+		Storage:      s.storage,
+		StorageClass: s.storageClass,
+	}
+	log.Printf("Launching %s's notebook", user)
+	if _, err := launch(s.clientset, nb, os.Stdout); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.show(w, user, caller)
+}
+
+// show responds with the status of the user's notebook, with its token if
+// it's the caller's.
+func (s *spawner) show(w http.ResponseWriter, user string, caller string) {
+	deployment, ok := s.getDeployment(w, user)
+	if !ok {
+		return
+	}
+	status, err := s.status(deployment, user == caller)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// stop stops the user's notebook, if it's the caller's, and responds with its
+// status.
+func (s *spawner) stop(w http.ResponseWriter, user string, caller string) {
+	if user != caller {
+		writeError(w, http.StatusForbidden, fmt.Errorf("%s can't stop %s's notebook", caller, user))
+		return
+	}
+	if _, ok := s.getDeployment(w, user); !ok {
+		return
+	}
+	log.Printf("Stopping %s's notebook", user)
+	if err := stop(s.clientset, s.namespace, user); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.show(w, user, caller)
+}
+
+// getDeployment gets the user's notebook deployment, responding with an error
+// if it can't.
+func (s *spawner) getDeployment(w http.ResponseWriter, user string) (*appsv1.Deployment, bool) {
+	n := &notebook{Namespace: s.namespace, User: user}
+	deployment, err := s.clientset.AppsV1().Deployments(s.namespace).Get(n.name(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s has no notebook", user))
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return deployment, true
+}
+
+// status describes the notebook run by the deployment.
+func (s *spawner) status(deployment *appsv1.Deployment, withToken bool) (notebookStatus, error) {
+	status := notebookStatus{
+		User:    deployment.ObjectMeta.Labels["user"],
+		Name:    deployment.ObjectMeta.Name,
+		Profile: deployment.ObjectMeta.Labels["profile"],
+		Running: deployment.Spec.Replicas == nil || *deployment.Spec.Replicas > 0,
+		Ready:   deployment.Status.ReadyReplicas > 0,
+	}
+	svc, err := s.clientset.CoreV1().Services(s.namespace).Get(deployment.ObjectMeta.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	address := ingressAddress(svc)
+	if address == "" {
+		return status, nil
+	}
+	status.URL = fmt.Sprintf("http://%s/", address)
+	if token := deploymentToken(deployment); withToken && token != "" {
+		status.URL = notebookURL(address, token)
+	}
+	return status, nil
+}
+
+// writeJSON responds with v as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeError responds with the error as JSON.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
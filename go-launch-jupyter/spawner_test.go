@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/theobarberbany/learning-client-go/apply/applytest"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// request makes a request of the handler as the user, who is given in the
+// X-Remote-User header.
+func request(t *testing.T, handler http.Handler, user, method, path string, body interface{}, response interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		assert.NoError(t, err)
+	}
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if user != "" {
+		req.Header.Set("X-Remote-User", user)
+	}
+	handler.ServeHTTP(recorder, req)
+	if response != nil {
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), response), recorder.Body.String())
+	}
+	return recorder.Code
+}
+
+func TestSpawner(t *testing.T) {
+	clientset := applytest.NewFakeClientset(nil)
+	s := &spawner{
+		clientset:  clientset,
+		namespace:  "team",
+		image:      "skippbox/jupyter:0.0.3",
+		git:        gitSource{Repo: "https://github.com/kubernetes-client/python.git", Depth: 1, Image: "alpine/git"},
+		storage:    resource.MustParse("1Gi"),
+		userHeader: "X-Remote-User",
+	}
+	handler := s.handler()
+
+	var status notebookStatus
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "POST", "/notebooks", launchRequest{User: "Alice"}, &status))
+	assert.Equal(t, notebookStatus{User: "alice", Name: "jupyter-alice", Profile: "small", Running: true}, status)
+	deployment, err := clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	token := deploymentToken(deployment)
+	assert.NotEmpty(t, token)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, profiles["small"], container.Resources)
+	assert.Equal(t, "jupyter-alice-home", deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+	_, err = clientset.CoreV1().PersistentVolumeClaims("team").Get("jupyter-alice-home", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	//Launching again changes the profile but keeps the token
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "POST", "/notebooks", launchRequest{User: "alice", Profile: "medium"}, &status))
+	assert.Equal(t, "medium", status.Profile)
+	deployment, err = clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, token, deploymentToken(deployment))
+	assert.Equal(t, profiles["medium"], deployment.Spec.Template.Spec.Containers[0].Resources)
+
+	assert.Equal(t, http.StatusOK, request(t, handler, "bob", "POST", "/notebooks", launchRequest{User: "bob"}, nil))
+	svc, err := clientset.CoreV1().Services("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	_, err = clientset.CoreV1().Services("team").Update(svc)
+	assert.NoError(t, err)
+
+	//Notebooks are listed without their tokens
+	var statuses []notebookStatus
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "GET", "/notebooks", nil, &statuses))
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "alice", statuses[0].User)
+		assert.Equal(t, "http://10.0.0.1:80/", statuses[0].URL)
+		assert.Equal(t, "bob", statuses[1].User)
+		assert.Empty(t, statuses[1].URL)
+	}
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "GET", "/notebooks/alice", nil, &status))
+	assert.Equal(t, "http://10.0.0.1:80/?token="+token, status.URL)
+
+	//Only the owner's view of a notebook has the token, and nobody else can
+	//stop it or launch it
+	var failure errorResponse
+	assert.Equal(t, http.StatusOK, request(t, handler, "bob", "GET", "/notebooks/alice", nil, &status))
+	assert.Equal(t, "http://10.0.0.1:80/", status.URL)
+	assert.Equal(t, http.StatusForbidden, request(t, handler, "bob", "POST", "/notebooks/alice/stop", nil, &failure))
+	assert.Equal(t, "bob can't stop alice's notebook", failure.Error)
+	assert.Equal(t, http.StatusForbidden, request(t, handler, "bob", "POST", "/notebooks", launchRequest{User: "alice"}, &failure))
+	assert.Equal(t, http.StatusUnauthorized, request(t, handler, "", "GET", "/notebooks/alice", nil, &failure))
+
+	//Stopping keeps the home directory
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "POST", "/notebooks/alice/stop", nil, &status))
+	assert.False(t, status.Running)
+	deployment, err = clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+	_, err = clientset.CoreV1().PersistentVolumeClaims("team").Get("jupyter-alice-home", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	//and launching starts it again
+	assert.Equal(t, http.StatusOK, request(t, handler, "alice", "POST", "/notebooks", launchRequest{User: "alice", Profile: "medium"}, &status))
+	assert.True(t, status.Running)
+
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, "alice", "POST", "/notebooks", launchRequest{User: "not a user"}, &failure))
+	assert.Contains(t, failure.Error, "can't use")
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, "carol", "POST", "/notebooks", launchRequest{User: "carol", Profile: "huge"}, &failure))
+	assert.Equal(t, `unknown profile "huge", must be one of small, medium, large`, failure.Error)
+	assert.Equal(t, http.StatusNotFound, request(t, handler, "alice", "GET", "/notebooks/carol", nil, &failure))
+	assert.Equal(t, http.StatusNotFound, request(t, handler, "carol", "POST", "/notebooks/carol/stop", nil, &failure))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(t, handler, "alice", "DELETE", "/notebooks/alice", nil, &failure))
+}
+
+func TestSpawnerAuth(t *testing.T) {
+	clientset := applytest.NewFakeClientset(nil)
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview)
+		if review.Spec.Token == "alice-token" {
+			review.Status = authv1.TokenReviewStatus{Authenticated: true, User: authv1.UserInfo{Username: "alice"}}
+		}
+		return true, review, nil
+	})
+	_, err := clientset.CoreV1().Secrets("team").Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "git-creds", Namespace: "team"},
+		Data:       map[string][]byte{tokenKey: []byte("secret")},
+	})
+	assert.NoError(t, err)
+	s := &spawner{
+		clientset: clientset,
+		namespace: "team",
+		image:     "skippbox/jupyter:0.0.3",
+		git:       gitSource{Repo: "https://github.com/team/notebooks.git", Depth: 1, Secret: "git-creds", Image: "alpine/git"},
+		storage:   resource.MustParse("1Gi"),
+	}
+	handler := s.handler()
+	launchAs := func(token string, req launchRequest) int {
+		data, err := json.Marshal(req)
+		assert.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/notebooks", bytes.NewReader(data))
+		r.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	//The caller is whoever the bearer token says, and the user defaults to them
+	assert.Equal(t, http.StatusUnauthorized, launchAs("stolen", launchRequest{}))
+	assert.Equal(t, http.StatusOK, launchAs("alice-token", launchRequest{}))
+	deployment, err := clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, deployment.Spec.Template.Spec.Volumes, 2, "the home directory and git credentials")
+
+	//The git credentials aren't given to clone any other repo
+	assert.Equal(t, http.StatusOK, launchAs("alice-token", launchRequest{Repo: "https://attacker.example/x"}))
+	deployment, err = clientset.AppsV1().Deployments("team").Get("jupyter-alice", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, deployment.Spec.Template.Spec.Volumes, 1, "only the home directory")
+	for _, mount := range deployment.Spec.Template.Spec.InitContainers[0].VolumeMounts {
+		assert.NotEqual(t, gitSecretDir, mount.MountPath)
+	}
+}
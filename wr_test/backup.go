@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+// lastBackupAnnotation records on a wr namespace when its database was last
+// successfully backed up, so that status can report it from anywhere.
+const lastBackupAnnotation = "wr-deployer/last-backup"
+
+// backupTimeFormat is the timestamp put in backup file names; it sorts in
+// time order. It's precise to the nanosecond so that backups taken in quick
+// succession don't clash.
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// checksumSuffix is added to a backup's name to get its checksum file.
+const checksumSuffix = ".sha256"
+
+// backupOpts configures the backup command.
+type backupOpts struct {
+	Dest       string
+	S3Endpoint string
+	Keep       int
+	Interval   time.Duration
+}
+
+func newBackupCmd() *cobra.Command {
+	var opts backupOpts
+	c := &cobra.Command{
+		Use:   "backup NAMESPACE",
+		Short: "Copy the wr manager's database backup to local storage",
+		Long: `Copies the manager's database backup (managerdbbkfile) out of its pod in to
+--dest, keeping the newest --keep copies, each with a sha256 checksum file.
+
+--dest is a local directory, or s3://bucket/prefix to upload to the
+S3-compatible object store at --s3-endpoint, such as a minio server. The
+credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and the
+region from AWS_REGION (us-east-1 by default).
+
+With --interval the backup keeps running, taking a new copy each interval.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.validate(); err != nil {
+				return err
+			}
+			store, err := newBackupStore(opts.Dest, opts.S3Endpoint)
+			if err != nil {
+				return err
+			}
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			wrConf, err := loadWrConfig(wrConfigPath)
+			if err != nil {
+				return err
+			}
+			for {
+				name, err := backupManagerDb(config, clientset, args[0], wrConf, store, opts.Keep)
+				switch {
+				case err == nil:
+					fmt.Printf("%s backed up to %s\n", time.Now().Format(time.RFC3339), name)
+				case opts.Interval == 0:
+					return err
+				default:
+					fmt.Fprintf(os.Stderr, "%s backup failed: %v\n", time.Now().Format(time.RFC3339), err)
+				}
+				if opts.Interval == 0 {
+					return nil
+				}
+				time.Sleep(opts.Interval)
+			}
+		},
+	}
+	c.Flags().StringVar(&opts.Dest, "dest", "wr_backups", "Directory, or s3://bucket/prefix, to store backups in")
+	c.Flags().StringVar(&opts.S3Endpoint, "s3-endpoint", "", "URL of the S3-compatible object store, for s3:// destinations")
+	c.Flags().IntVar(&opts.Keep, "keep", 7, "Number of backups to keep")
+	c.Flags().DurationVar(&opts.Interval, "interval", 0, "Keep running, taking a backup this often")
+	return c
+}
+
+// validate checks the options make sense before anything is copied.
+func (o *backupOpts) validate() error {
+	if o.Keep < 1 {
+		return fmt.Errorf("--keep must be at least 1, not %d", o.Keep)
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("--interval can't be negative")
+	}
+	return nil
+}
+
+// backupStore is somewhere backups are kept: a local directory or an S3
+// bucket.
+type backupStore interface {
+	// tempDir is the local directory to stream a new backup in to, or "" for
+	// the default temp directory.
+	tempDir() (string, error)
+	// save stores the complete backup in tmp under name, or name with a
+	// counter added if it's taken, along with its checksum file. It returns
+	// where the backup was put.
+	save(tmp *os.File, name string, sum string) (string, error)
+	// rotate deletes all but the newest keep backups of the named file.
+	rotate(base string, keep int) error
+}
+
+// newBackupStore works out the store a backup destination refers to.
+func newBackupStore(dest string, s3Endpoint string) (backupStore, error) {
+	if !strings.HasPrefix(dest, "s3://") {
+		return dirStore(dest), nil
+	}
+	if s3Endpoint == "" {
+		return nil, fmt.Errorf("an s3:// destination needs --s3-endpoint")
+	}
+	bucket := strings.Trim(strings.TrimPrefix(dest, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket in %s", dest)
+	}
+	client, err := newS3Client(s3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	store := &s3Store{client: client, bucket: bucket}
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		store.bucket, store.prefix = bucket[:i], bucket[i+1:]+"/"
+	}
+	return store, nil
+}
+
+// dirStore keeps backups in a local directory.
+type dirStore string
+
+func (d dirStore) tempDir() (string, error) {
+	//Streaming in to the same directory lets the backup be linked in to place
+	return string(d), os.MkdirAll(string(d), 0700)
+}
+
+func (d dirStore) save(tmp *os.File, name string, sum string) (string, error) {
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return "", err
+	}
+	backup, err := linkBackup(tmp.Name(), filepath.Join(string(d), name))
+	if err != nil {
+		return "", err
+	}
+	return backup, ioutil.WriteFile(backup+checksumSuffix, []byte(sum+"  "+filepath.Base(backup)+"\n"), 0600)
+}
+
+func (d dirStore) rotate(base string, keep int) error {
+	return rotateBackups(string(d), base, keep)
+}
+
+// s3Store keeps backups under a prefix in an S3 bucket.
+type s3Store struct {
+	client *s3Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) tempDir() (string, error) {
+	return "", nil
+}
+
+func (s *s3Store) save(tmp *os.File, name string, sum string) (string, error) {
+	key := s.prefix + name
+	for i := 1; ; i++ {
+		err := s.client.putNew(s.bucket, key, tmp, sum)
+		if err == nil {
+			break
+		}
+		if err != errS3Exists || i == 100 {
+			return "", err
+		}
+		key = fmt.Sprintf("%s%s-%d", s.prefix, name, i)
+	}
+	location := "s3://" + s.bucket + "/" + key
+	if err := s.client.put(s.bucket, key+checksumSuffix, []byte(sum+"  "+path.Base(key)+"\n")); err != nil {
+		return location, err
+	}
+	return location, nil
+}
+
+func (s *s3Store) rotate(base string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("refusing to keep fewer than 1 backup")
+	}
+	keys, err := s.client.list(s.bucket, s.prefix+base+".")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, checksumSuffix) && !strings.Contains(strings.TrimPrefix(key, s.prefix), "/") {
+			backups = append(backups, key)
+		}
+	}
+	for i := 0; i < len(backups)-keep; i++ {
+		if err := s.client.remove(s.bucket, backups[i]); err != nil {
+			return err
+		}
+		if err := s.client.remove(s.bucket, backups[i]+checksumSuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupManagerDb copies the database backup out of the manager pod in the
+// given namespace in to the store, deletes all but the newest keep backups
+// and records the time of the backup on the namespace. It returns where the
+// new backup was put.
+func backupManagerDb(config *rest.Config, clientset kubernetes.Interface, namespace string, wrConf *wrConfig, store backupStore, keep int) (string, error) {
+	pod, err := runningManagerPod(clientset, namespace)
+	if err != nil {
+		return "", err
+	}
+	if pod == nil {
+		return "", fmt.Errorf("no wr manager running in namespace %s", namespace)
+	}
+	dir, err := store.tempDir()
+	if err != nil {
+		return "", err
+	}
+
+	//Stream the backup in to a temp file, so it's only stored once we know
+	//it's complete.
+	tmp, err := ioutil.TempFile(dir, ".incoming")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	counter := &countingWriter{}
+	var stderr bytes.Buffer
+	remote := wrConf.managerFile(wrConf.ManagerDbBkFile)
+	err = execInContainer(config, clientset, pod, "wr-manager", []string{"cat", remote}, io.MultiWriter(tmp, hash, counter), &stderr)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to copy %s: %v: %s", remote, err, strings.TrimSpace(stderr.String()))
+	}
+	if counter.n == 0 {
+		return "", fmt.Errorf("backup %s is empty", remote)
+	}
+
+	now := time.Now().UTC()
+	base := path.Base(remote)
+	name, err := store.save(tmp, base+"."+now.Format(backupTimeFormat), hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return name, err
+	}
+	if err := store.rotate(base, keep); err != nil {
+		return name, err
+	}
+	return name, recordBackup(clientset, namespace, now)
+}
+
+// linkBackup links the new backup at tmp in to place at name, never replacing
+// an existing backup: if name is taken a counter is added to it. It returns
+// the name used.
+func linkBackup(tmp string, name string) (string, error) {
+	target := name
+	for i := 1; ; i++ {
+		err := os.Link(tmp, target)
+		if err == nil {
+			return target, nil
+		}
+		if !os.IsExist(err) || i == 100 {
+			return "", err
+		}
+		target = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// listBackups returns the backups of the named file in dir, oldest first.
+func listBackups(dir string, base string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, base+".*"))
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, checksumSuffix) {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// rotateBackups deletes all but the newest keep backups of the named file.
+// keep must be at least 1, so the backup just taken is never deleted.
+func rotateBackups(dir string, base string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("refusing to keep fewer than 1 backup")
+	}
+	backups, err := listBackups(dir, base)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(backups)-keep; i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			return err
+		}
+		if err := os.Remove(backups[i] + checksumSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBackup checks a backup against its checksum file.
+func verifyBackup(name string) error {
+	want, err := ioutil.ReadFile(name + checksumSuffix)
+	if err != nil {
+		return fmt.Errorf("no checksum for %s: %v", name, err)
+	}
+	fields := strings.Fields(string(want))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file for %s", name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != fields[0] {
+		return fmt.Errorf("checksum mismatch for %s", name)
+	}
+	return nil
+}
+
+// recordBackup notes the time of the latest good backup on the namespace.
+func recordBackup(clientset kubernetes.Interface, namespace string, when time.Time) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ns.ObjectMeta.Annotations == nil {
+			ns.ObjectMeta.Annotations = map[string]string{}
+		}
+		ns.ObjectMeta.Annotations[lastBackupAnnotation] = when.UTC().Format(time.RFC3339)
+		_, err = clientset.CoreV1().Namespaces().Update(ns)
+		return err
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// batchOpts configures running a command across many pods.
+type batchOpts struct {
+	Selector  string
+	AllWr     bool
+	Container string
+	Parallel  int
+	Timeout   time.Duration
+	MaxOutput int
+	Output    string
+}
+
+// batchResult is what the command did in one pod.
+type batchResult struct {
+	Namespace string        `json:"namespace"`
+	Pod       string        `json:"pod"`
+	ExitCode  int           `json:"exitCode"`
+	Error     string        `json:"error,omitempty"`
+	Stdout    string        `json:"stdout"`
+	Stderr    string        `json:"stderr"`
+	Took      time.Duration `json:"tookNanoseconds"`
+	// Group numbers the distinct outcomes, 1 being the most common.
+	Group int `json:"group"`
+}
+
+// outcome identifies how the command went, for grouping pods where it went
+// the same way.
+func (r *batchResult) outcome() string {
+	return fmt.Sprintf("%d\x00%s\x00%s", r.ExitCode, r.Error, r.Stdout)
+}
+
+// batchGroup is a set of pods where the command had the same outcome.
+type batchGroup struct {
+	Group    int      `json:"group"`
+	ExitCode int      `json:"exitCode"`
+	Error    string   `json:"error,omitempty"`
+	Stdout   string   `json:"stdout"`
+	Pods     []string `json:"pods"`
+}
+
+func newBatchExecCmd() *cobra.Command {
+	var opts batchOpts
+	c := &cobra.Command{
+		Use:   "batch-exec (NAMESPACE | --all-wr) -- COMMAND [ARG...]",
+		Short: "Run a command in many pods and compare the results",
+		Long: `Runs a command in every running pod matching --selector in the namespace, or
+in every wr namespace with --all-wr, up to --parallel at a time. Pods whose
+command exited the same way with the same output are grouped together, so the
+odd ones out stand out: the table lists each pod with its group, followed by
+each group's output, most common first. -o json gives the same as JSON.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dash := cmd.ArgsLenAtDash()
+			if dash < 0 || dash == len(args) {
+				return fmt.Errorf("give the command to run after --")
+			}
+			namespaces, command := args[:dash], args[dash:]
+			if opts.AllWr == (len(namespaces) == 1) || len(namespaces) > 1 {
+				return fmt.Errorf("give either a namespace or --all-wr")
+			}
+			if opts.Parallel < 1 {
+				return fmt.Errorf("--parallel must be at least 1")
+			}
+			if opts.MaxOutput < 1 {
+				return fmt.Errorf("--max-output must be at least 1")
+			}
+			if opts.Output != "table" && opts.Output != "json" {
+				return fmt.Errorf("unknown output format %q, must be table or json", opts.Output)
+			}
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			if opts.AllWr {
+				namespaces, err = wrNamespaceNames(clientset)
+				if err != nil {
+					return err
+				}
+			}
+			pods, err := batchPods(clientset, namespaces, opts.Selector)
+			if err != nil {
+				return err
+			}
+			results := batchExec(config, clientset, pods, command, &opts)
+			groups := groupBatchResults(results)
+			if opts.Output == "json" {
+				return printBatchJSON(results, groups, os.Stdout)
+			}
+			printBatchTable(results, groups, os.Stdout)
+			return nil
+		},
+	}
+	c.Flags().StringVarP(&opts.Selector, "selector", "l", "", "Label selector of the pods to run the command in (defaults to all)")
+	c.Flags().BoolVar(&opts.AllWr, "all-wr", false, "Run in pods of every namespace created by the deployer")
+	c.Flags().StringVarP(&opts.Container, "container", "c", "", "Container to run the command in (defaults to each pod's first container)")
+	c.Flags().IntVar(&opts.Parallel, "parallel", 10, "Number of pods to run the command in at once")
+	c.Flags().DurationVarP(&opts.Timeout, "timeout", "t", time.Minute, "How long the command may take in each pod")
+	c.Flags().IntVar(&opts.MaxOutput, "max-output", 16*1024, "Bytes of output to keep from each pod")
+	c.Flags().StringVarP(&opts.Output, "output", "o", "table", "Output format: table or json")
+	return c
+}
+
+// wrNamespaceNames returns the names of the namespaces created by the
+// deployer that aren't being deleted.
+func wrNamespaceNames(clientset kubernetes.Interface) ([]string, error) {
+	nsList, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{
+		LabelSelector: managedSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wr namespaces: %v", err)
+	}
+	var names []string
+	for _, ns := range nsList.Items {
+		if ns.Status.Phase != apiv1.NamespaceTerminating {
+			names = append(names, ns.ObjectMeta.Name)
+		}
+	}
+	return names, nil
+}
+
+// batchPods returns the running pods matching the selector in each of the
+// namespaces.
+func batchPods(clientset kubernetes.Interface, namespaces []string, selector string) ([]apiv1.Pod, error) {
+	var pods []apiv1.Pod
+	for _, namespace := range namespaces {
+		podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range podList.Items {
+			if pod.Status.Phase == apiv1.PodRunning {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no running pods found")
+	}
+	return pods, nil
+}
+
+// batchExec runs the command in every pod, at most opts.Parallel at a time,
+// returning a result for each pod in the same order.
+func batchExec(config *rest.Config, clientset kubernetes.Interface, pods []apiv1.Pod, command []string, opts *batchOpts) []batchResult {
+	results := make([]batchResult, len(pods))
+	slots := make(chan struct{}, opts.Parallel)
+	var wg sync.WaitGroup
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			pod := &pods[i]
+			container := opts.Container
+			if container == "" {
+				container = pod.Spec.Containers[0].Name
+			}
+			run, err := podexec.Run(config, clientset, podexec.Options{
+				Namespace: pod.ObjectMeta.Namespace,
+				Pod:       pod.ObjectMeta.Name,
+				Container: container,
+				Command:   command,
+				Timeout:   opts.Timeout,
+				MaxOutput: opts.MaxOutput,
+				Transport: execTransport,
+			})
+			result := batchResult{
+				Namespace: pod.ObjectMeta.Namespace,
+				Pod:       pod.ObjectMeta.Name,
+				ExitCode:  run.ExitCode,
+				Stdout:    run.Stdout.String(),
+				Stderr:    run.Stderr.String(),
+				Took:      run.Took,
+			}
+			if err != nil && !podexec.IsCommandFailure(err) {
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// groupBatchResults sorts the results in to groups with the same exit code,
+// error and stdout, numbering them from the most common, and sets each
+// result's Group.
+func groupBatchResults(results []batchResult) []*batchGroup {
+	byKey := make(map[string]*batchGroup)
+	var groups []*batchGroup
+	for _, result := range results {
+		key := result.outcome()
+		group, ok := byKey[key]
+		if !ok {
+			group = &batchGroup{ExitCode: result.ExitCode, Error: result.Error, Stdout: result.Stdout}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.Pods = append(group.Pods, result.Namespace+"/"+result.Pod)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Pods) > len(groups[j].Pods)
+	})
+	for i, group := range groups {
+		group.Group = i + 1
+	}
+	for i := range results {
+		results[i].Group = byKey[results[i].outcome()].Group
+	}
+	return groups
+}
+
+// printBatchTable writes a table of the pods and their groups, then the
+// output of each group.
+func printBatchTable(results []batchResult, groups []*batchGroup, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tEXIT\tTOOK\tGROUP")
+	for _, result := range results {
+		exit := fmt.Sprint(result.ExitCode)
+		if result.Error != "" {
+			exit = "error"
+		}
+		group := fmt.Sprint(result.Group)
+		if len(groups) > 1 && result.Group != 1 {
+			group += " (differs)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Namespace, result.Pod, exit, result.Took.Round(time.Millisecond), group)
+	}
+	w.Flush()
+	for _, group := range groups {
+		fmt.Fprintf(out, "\n== group %d: %d pods, ", group.Group, len(group.Pods))
+		if group.Error != "" {
+			fmt.Fprintf(out, "%s ==\n", group.Error)
+		} else {
+			fmt.Fprintf(out, "exit %d ==\n", group.ExitCode)
+		}
+		if group.Stdout != "" {
+			fmt.Fprintln(out, strings.TrimSuffix(group.Stdout, "\n"))
+		}
+	}
+}
+
+// printBatchJSON writes the results and groups as JSON.
+func printBatchJSON(results []batchResult, groups []*batchGroup, out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Results []batchResult `json:"results"`
+		Groups  []*batchGroup `json:"groups"`
+	}{results, groups})
+}
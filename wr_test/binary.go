@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Where the init container gets the wr binary from.
+const (
+	binaryFromAttach = "attach"
+	binaryFromURL    = "url"
+	binaryFromCache  = "cache"
+)
+
+// binaryCacheVolume is the name of the volume holding the node's binary cache.
+const binaryCacheVolume = "wr-cache"
+
+// Node labels giving the os and architecture of a node. Older clusters only
+// set the beta labels.
+const (
+	archLabel     = "kubernetes.io/arch"
+	osLabel       = "kubernetes.io/os"
+	betaArchLabel = "beta.kubernetes.io/arch"
+	betaOSLabel   = "beta.kubernetes.io/os"
+)
+
+// sha256Pattern matches a hex encoded sha256 checksum.
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// binaryOpts configures how the wr binary gets in to the manager pod. By
+// default it's streamed from here in to the init container, but the init
+// container can instead download it from a URL, or copy it from a cache
+// directory on the node, verifying its checksum either way. That avoids
+// sending the binary over a slow link for every deployment.
+type binaryOpts struct {
+	Source string
+	URL    string
+	// CachePath is the path of the binary on the nodes, eg. kept up to date by
+	// a DaemonSet.
+	CachePath string
+	SHA256    string
+	// FetchImage is the image of the init container when downloading; it
+	// needs curl and sha256sum.
+	FetchImage string
+	// Platforms are the local binaries to attach, as os/arch=path. When
+	// empty ./wr is attached whatever the node.
+	Platforms []string
+}
+
+// addFlags registers the binary options on the given command.
+func (b *binaryOpts) addFlags(c *cobra.Command) {
+	c.Flags().StringVar(&b.Source, "binary-source", binaryFromAttach,
+		"How the pod gets the wr binary: attach (stream it from here), url or cache")
+	c.Flags().StringVar(&b.URL, "binary-url", "",
+		"http(s) URL to download the wr binary from, with --binary-source=url")
+	c.Flags().StringVar(&b.CachePath, "binary-cache", "/var/cache/wr/wr",
+		"Path of the wr binary on the nodes, with --binary-source=cache")
+	c.Flags().StringVar(&b.SHA256, "binary-sha256", "",
+		"sha256 checksum the fetched binary must have (required for url and cache)")
+	c.Flags().StringVar(&b.FetchImage, "fetch-image", "buildpack-deps:curl",
+		"Image used to download the binary, with --binary-source=url")
+	c.Flags().StringArrayVar(&b.Platforms, "binary", nil,
+		"os/arch=path of a wr binary to attach to pods on nodes of that platform, "+
+			"eg. linux/arm64=./wr-arm64 (repeatable)")
+}
+
+// validate checks the options make sense.
+func (b *binaryOpts) validate() error {
+	switch b.Source {
+	case binaryFromAttach:
+		binaries, err := b.binaries()
+		if err != nil {
+			return err
+		}
+		for _, binary := range binaries {
+			if _, err := os.Stat(binary); err != nil {
+				return err
+			}
+		}
+		return nil
+	case binaryFromURL:
+		if b.URL == "" {
+			return fmt.Errorf("--binary-source=url needs --binary-url")
+		}
+		if b.SHA256 == "" {
+			return fmt.Errorf("--binary-source=url needs --binary-sha256")
+		}
+	case binaryFromCache:
+		if !path.IsAbs(b.CachePath) {
+			return fmt.Errorf("--binary-cache must be an absolute path")
+		}
+		//Anything on the node could have put it there
+		if b.SHA256 == "" {
+			return fmt.Errorf("--binary-source=cache needs --binary-sha256")
+		}
+	default:
+		return fmt.Errorf("unknown binary source %q, must be attach, url or cache", b.Source)
+	}
+	if len(b.Platforms) > 0 {
+		return fmt.Errorf("--binary needs --binary-source=attach")
+	}
+	if b.SHA256 != "" && !sha256Pattern.MatchString(b.SHA256) {
+		return fmt.Errorf("%q is not a sha256 checksum", b.SHA256)
+	}
+	return nil
+}
+
+// location describes where the binary is fetched from.
+func (b *binaryOpts) location() string {
+	if b.Source == binaryFromURL {
+		return b.URL
+	}
+	return "node cache " + b.CachePath
+}
+
+// fetchInitContainer changes the pod to fetch the wr binary in to tmpDir
+// (mounted from tmpVolume) from a URL or the node cache, instead of waiting
+// for it to be attached. The binary is only put in place once its checksum
+// (which validate makes sure was given) has been verified, and the init
+// container fails otherwise, so the manager never starts with a bad binary.
+func (b *binaryOpts) fetchInitContainer(podSpec *apiv1.PodSpec, tmpVolume string, tmpDir string) {
+	if b.Source == binaryFromAttach {
+		return
+	}
+	partial := path.Join(tmpDir, "wr.part")
+	final := path.Join(tmpDir, "wr")
+	var fetch string
+	image := b.FetchImage
+	mounts := []apiv1.VolumeMount{
+		{
+			Name:      tmpVolume,
+			MountPath: tmpDir,
+		},
+	}
+	if b.Source == binaryFromURL {
+		fetch = fmt.Sprintf("curl -fsSL -o %s %s", shellQuote(partial), shellQuote(b.URL))
+	} else {
+		cacheDir := path.Dir(b.CachePath)
+		podSpec.Volumes = append(podSpec.Volumes, apiv1.Volume{
+			Name: binaryCacheVolume,
+			VolumeSource: apiv1.VolumeSource{
+				HostPath: &apiv1.HostPathVolumeSource{
+					Path: cacheDir,
+				},
+			},
+		})
+		mounts = append(mounts, apiv1.VolumeMount{
+			Name:      binaryCacheVolume,
+			MountPath: "/wr-cache",
+			ReadOnly:  true,
+		})
+		fetch = fmt.Sprintf("cp %s %s", shellQuote(path.Join("/wr-cache", path.Base(b.CachePath))), shellQuote(partial))
+		image = podSpec.Containers[0].Image
+	}
+	script := fetch
+	script += fmt.Sprintf(" && echo %s | sha256sum -c -", shellQuote(b.SHA256+"  "+partial))
+	script += fmt.Sprintf(" && chmod 755 %s && mv %s %s", shellQuote(partial), shellQuote(partial), shellQuote(final))
+
+	podSpec.InitContainers = []apiv1.Container{
+		{
+			Name:         "init-container",
+			Image:        image,
+			Command:      []string{"/bin/sh", "-c", script},
+			VolumeMounts: mounts,
+		},
+	}
+}
+
+// binaries parses the --binary options in to a map of os/arch to the path of
+// the binary for that platform.
+func (b *binaryOpts) binaries() (map[string]string, error) {
+	binaries := make(map[string]string)
+	for _, platform := range b.Platforms {
+		parts := strings.SplitN(platform, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("--binary %q is not of the form os/arch=path", platform)
+		}
+		osArch := strings.Split(parts[0], "/")
+		if len(osArch) != 2 || osArch[0] == "" || osArch[1] == "" {
+			return nil, fmt.Errorf("--binary %q does not start with os/arch", platform)
+		}
+		if _, exists := binaries[parts[0]]; exists {
+			return nil, fmt.Errorf("more than one --binary for %s", parts[0])
+		}
+		binaries[parts[0]] = parts[1]
+	}
+	return binaries, nil
+}
+
+// binaryFor picks the local binary to attach to a pod running on the given
+// node. With no --binary options that's wr in the current directory, which is
+// trusted to suit the node; otherwise it's the binary for the node's os and
+// architecture, and it's an error if there isn't one.
+func (b *binaryOpts) binaryFor(node *apiv1.Node) (string, error) {
+	binaries, err := b.binaries()
+	if err != nil {
+		return "", err
+	}
+	if len(binaries) == 0 {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		return path.Join(dir, "wr"), nil
+	}
+	platform, err := nodePlatform(node)
+	if err != nil {
+		return "", err
+	}
+	if binary, ok := binaries[platform]; ok {
+		return binary, nil
+	}
+	var have []string
+	for p := range binaries {
+		have = append(have, p)
+	}
+	sort.Strings(have)
+	return "", fmt.Errorf("node %s is %s, but there is only a wr binary for %s", node.ObjectMeta.Name, platform, strings.Join(have, ", "))
+}
+
+// nodePlatform returns the os/arch of a node from its labels.
+func nodePlatform(node *apiv1.Node) (string, error) {
+	label := func(names ...string) string {
+		for _, name := range names {
+			if value := node.ObjectMeta.Labels[name]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	nodeOS := label(osLabel, betaOSLabel)
+	arch := label(archLabel, betaArchLabel)
+	if nodeOS == "" || arch == "" {
+		return "", fmt.Errorf("node %s has no %s and %s labels, so can't pick a wr binary for it", node.ObjectMeta.Name, betaOSLabel, betaArchLabel)
+	}
+	return nodeOS + "/" + arch, nil
+}
+
+// scheduledNode waits for the pod to be scheduled and returns the node it was
+// put on.
+func scheduledNode(clientset kubernetes.Interface, pod *apiv1.Pod, timeout time.Duration) (*apiv1.Node, error) {
+	nodeName := pod.Spec.NodeName
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		if nodeName != "" {
+			return true, nil
+		}
+		current, err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Get(pod.ObjectMeta.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		nodeName = current.Spec.NodeName
+		return nodeName != "", nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, fmt.Errorf("pod %s was not scheduled within %s", pod.ObjectMeta.Name, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+}
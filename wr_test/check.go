@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// checkState is the result of a check, with the values Nagios and Icinga
+// plugins exit with.
+type checkState int
+
+const (
+	stateOK checkState = iota
+	stateWarning
+	stateCritical
+	stateUnknown
+)
+
+func (s checkState) String() string {
+	switch s {
+	case stateOK:
+		return "OK"
+	case stateWarning:
+		return "WARNING"
+	case stateCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// worse returns whichever of the states is more serious: CRITICAL, then
+// WARNING, then UNKNOWN, then OK.
+func (s checkState) worse(other checkState) checkState {
+	rank := map[checkState]int{stateOK: 0, stateUnknown: 1, stateWarning: 2, stateCritical: 3}
+	if rank[other] > rank[s] {
+		return other
+	}
+	return s
+}
+
+// checkOpts configures the check command.
+type checkOpts struct {
+	Pod       string
+	Selector  string
+	Container string
+	Timeout   time.Duration
+	// TimeoutUnknown makes a timeout UNKNOWN instead of CRITICAL.
+	TimeoutUnknown bool
+	// PluginExitCodes takes exit codes 0-3 as plugin states, rather than
+	// treating any failure as CRITICAL.
+	PluginExitCodes bool
+	Warning         string
+	Critical        string
+	// ValuePattern finds the value compared to the thresholds in the
+	// command's output: its first submatch, or whole match if it has none.
+	ValuePattern string
+	Label        string
+}
+
+func newCheckCmd() *cobra.Command {
+	var opts checkOpts
+	c := &cobra.Command{
+		Use:   "check NAMESPACE -- COMMAND [ARG...]",
+		Short: "Run a command in pods as a Nagios/Icinga check",
+		Long: `Runs a command in a container of the wr manager pod, the pod given by --pod, or
+every running pod matching --selector, and turns the results in to a
+Nagios/Icinga plugin result: a line of output with perfdata, and an exit
+status of 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN). With more than one
+pod the worst result is used.
+
+A command exiting 0 is OK and anything else CRITICAL, unless
+--plugin-exit-codes is given, when exit codes 0-3 are used as they are. A
+command that can't be run, or whose output can't be understood, is UNKNOWN.
+
+--warning and --critical are Nagios threshold ranges (eg. 10, 10:, ~:10,
+10:20 or @10:20) checked against a number in the command's output, by default
+the first one.`,
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			state, output := check(args[0], args[1:], &opts)
+			fmt.Println(output)
+			os.Exit(int(state))
+		},
+	}
+	c.Flags().StringVarP(&opts.Pod, "pod", "p", "", "Pod to run the command in (defaults to the wr manager)")
+	c.Flags().StringVarP(&opts.Selector, "selector", "l", "", "Run the command in every running pod matching this label selector")
+	c.Flags().StringVarP(&opts.Container, "container", "c", "", "Container to run the command in (defaults to the pod's first container)")
+	c.Flags().DurationVarP(&opts.Timeout, "timeout", "t", 30*time.Second, "How long the command may take")
+	c.Flags().BoolVarP(&opts.TimeoutUnknown, "timeout-unknown", "u", false, "Return UNKNOWN instead of CRITICAL on timeout")
+	c.Flags().BoolVar(&opts.PluginExitCodes, "plugin-exit-codes", false, "The command is a plugin: use its exit codes 0-3 as the state")
+	c.Flags().StringVarP(&opts.Warning, "warning", "w", "", "WARNING threshold range for the value in the output")
+	c.Flags().StringVar(&opts.Critical, "critical", "", "CRITICAL threshold range for the value in the output")
+	c.Flags().StringVar(&opts.ValuePattern, "value-pattern", `-?[0-9]+(?:\.[0-9]+)?`, "Regular expression finding the value in the output")
+	c.Flags().StringVar(&opts.Label, "label", "value", "Perfdata label of the value")
+	return c
+}
+
+// check runs the command in the pods chosen by opts, returning the overall
+// state and the plugin output line.
+func check(namespace string, command []string, opts *checkOpts) (checkState, string) {
+	thresholds, err := opts.thresholds()
+	if err != nil {
+		return stateUnknown, "EXEC UNKNOWN - " + err.Error()
+	}
+	config, clientset, err := authenticate()
+	if err != nil {
+		return stateUnknown, "EXEC UNKNOWN - " + err.Error()
+	}
+	pods, err := checkPods(clientset, namespace, opts)
+	if err != nil {
+		return stateUnknown, "EXEC UNKNOWN - " + err.Error()
+	}
+	var results []checkResult
+	for i := range pods {
+		results = append(results, runCheck(config, clientset, &pods[i], command, opts, thresholds))
+	}
+	return formatCheck(results, opts.Label, thresholds)
+}
+
+// checkPods returns the pods to run the check in.
+func checkPods(clientset kubernetes.Interface, namespace string, opts *checkOpts) ([]apiv1.Pod, error) {
+	if opts.Selector == "" {
+		pod, err := targetPod(clientset, namespace, opts.Pod)
+		if err != nil {
+			return nil, err
+		}
+		if pod == nil {
+			return nil, fmt.Errorf("no wr manager running in namespace %s", namespace)
+		}
+		return []apiv1.Pod{*pod}, nil
+	}
+	if opts.Pod != "" {
+		return nil, fmt.Errorf("give only one of --pod or --selector")
+	}
+	podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: opts.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []apiv1.Pod
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == apiv1.PodRunning {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no running pods match %q in namespace %s", opts.Selector, namespace)
+	}
+	return pods, nil
+}
+
+// checkThresholds are the parsed threshold options; either range may be nil.
+type checkThresholds struct {
+	Warning  *nagiosRange
+	Critical *nagiosRange
+	Pattern  *regexp.Regexp
+}
+
+// thresholds parses the threshold options.
+func (o *checkOpts) thresholds() (*checkThresholds, error) {
+	t := &checkThresholds{}
+	var err error
+	if o.Warning != "" {
+		if t.Warning, err = parseNagiosRange(o.Warning); err != nil {
+			return nil, err
+		}
+	}
+	if o.Critical != "" {
+		if t.Critical, err = parseNagiosRange(o.Critical); err != nil {
+			return nil, err
+		}
+	}
+	if t.Pattern, err = regexp.Compile(o.ValuePattern); err != nil {
+		return nil, fmt.Errorf("bad --value-pattern: %v", err)
+	}
+	return t, nil
+}
+
+// checkResult is the outcome of running the check in one pod.
+type checkResult struct {
+	Pod      string
+	State    checkState
+	Message  string
+	Value    float64
+	HasValue bool
+	Took     time.Duration
+}
+
+// runCheck runs the command in the pod and judges the result.
+func runCheck(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, command []string, opts *checkOpts, thresholds *checkThresholds) checkResult {
+	container := opts.Container
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	run, err := podexec.Run(config, clientset, podexec.Options{
+		Namespace: pod.ObjectMeta.Namespace,
+		Pod:       pod.ObjectMeta.Name,
+		Container: container,
+		Command:   command,
+		Timeout:   opts.Timeout,
+		Transport: execTransport,
+	})
+	switch err.(type) {
+	case *podexec.TimeoutError:
+		state := stateCritical
+		if opts.TimeoutUnknown {
+			state = stateUnknown
+		}
+		return checkResult{Pod: pod.ObjectMeta.Name, State: state, Message: err.Error(), Took: run.Took}
+	case *podexec.StreamError:
+		return checkResult{Pod: pod.ObjectMeta.Name, State: stateUnknown, Message: err.Error(), Took: run.Took}
+	}
+	result := judgeCheck(run.ExitCode, run.Stdout.String(), run.Stderr.String(), opts.PluginExitCodes, thresholds)
+	result.Pod = pod.ObjectMeta.Name
+	result.Took = run.Took
+	return result
+}
+
+// judgeCheck works out the state of a check from the command's exit code and
+// output.
+func judgeCheck(exitCode int, stdout string, stderr string, pluginExitCodes bool, thresholds *checkThresholds) checkResult {
+	var result checkResult
+	switch {
+	case exitCode == 0:
+		result.State = stateOK
+	case pluginExitCodes && exitCode <= int(stateUnknown):
+		result.State = checkState(exitCode)
+	default:
+		result.State = stateCritical
+	}
+	result.Message = firstLine(stdout)
+	if result.Message == "" {
+		result.Message = firstLine(stderr)
+	}
+	if exitCode != 0 {
+		result.Message = strings.TrimSpace(fmt.Sprintf("exit status %d %s", exitCode, result.Message))
+	}
+
+	if thresholds.Warning == nil && thresholds.Critical == nil {
+		return result
+	}
+	match := thresholds.Pattern.FindStringSubmatch(stdout)
+	if match == nil {
+		result.State = result.State.worse(stateUnknown)
+		result.Message = strings.TrimSpace("no value in output " + result.Message)
+		return result
+	}
+	value, err := strconv.ParseFloat(match[len(match)-1], 64)
+	if err != nil {
+		result.State = result.State.worse(stateUnknown)
+		result.Message = fmt.Sprintf("bad value %q in output", match[len(match)-1])
+		return result
+	}
+	result.Value, result.HasValue = value, true
+	switch {
+	case thresholds.Critical != nil && thresholds.Critical.alerts(value):
+		result.State = result.State.worse(stateCritical)
+	case thresholds.Warning != nil && thresholds.Warning.alerts(value):
+		result.State = result.State.worse(stateWarning)
+	}
+	return result
+}
+
+// firstLine returns the first non-blank line of s, trimmed.
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// formatCheck combines the results of a check in to the overall state and
+// the plugin output line, with perfdata for each pod's value and time taken.
+func formatCheck(results []checkResult, label string, thresholds *checkThresholds) (checkState, string) {
+	state := stateOK
+	var messages, perfdata []string
+	for _, result := range results {
+		state = state.worse(result.State)
+		prefix := ""
+		if len(results) > 1 {
+			messages = append(messages, fmt.Sprintf("%s %s: %s", result.Pod, result.State, result.Message))
+			prefix = result.Pod + "_"
+		} else {
+			messages = append(messages, result.Message)
+		}
+		if result.HasValue {
+			perfdata = append(perfdata, fmt.Sprintf("'%s%s'=%s;%s;%s", prefix, label,
+				strconv.FormatFloat(result.Value, 'f', -1, 64), thresholds.Warning, thresholds.Critical))
+		}
+		perfdata = append(perfdata, fmt.Sprintf("'%stime'=%.3fs;;;0", prefix, result.Took.Seconds()))
+	}
+	return state, fmt.Sprintf("EXEC %s - %s | %s", state, strings.Join(messages, "; "), strings.Join(perfdata, " "))
+}
+
+// nagiosRange is a threshold range as used by Nagios plugins: a value alerts
+// if it is outside start:end, or inside it if Inside is set.
+type nagiosRange struct {
+	spec   string
+	Start  float64
+	End    float64
+	Inside bool
+}
+
+// parseNagiosRange parses a range of the form [@][start:][end], where start
+// defaults to 0, end to infinity, and a start of ~ means minus infinity.
+func parseNagiosRange(spec string) (*nagiosRange, error) {
+	r := &nagiosRange{spec: spec, End: math.Inf(1)}
+	s := spec
+	if strings.HasPrefix(s, "@") {
+		r.Inside = true
+		s = s[1:]
+	}
+	end := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		start := s[:i]
+		end = s[i+1:]
+		switch start {
+		case "~":
+			r.Start = math.Inf(-1)
+		case "":
+		default:
+			v, err := strconv.ParseFloat(start, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad threshold range %q", spec)
+			}
+			r.Start = v
+		}
+	} else if end == "" {
+		return nil, fmt.Errorf("empty threshold range")
+	}
+	if end != "" {
+		v, err := strconv.ParseFloat(end, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad threshold range %q", spec)
+		}
+		r.End = v
+	}
+	if r.Start > r.End {
+		return nil, fmt.Errorf("threshold range %q starts after it ends", spec)
+	}
+	return r, nil
+}
+
+// alerts reports whether the value is outside the range, or inside it for an
+// @ range.
+func (r *nagiosRange) alerts(v float64) bool {
+	outside := v < r.Start || v > r.End
+	if r.Inside {
+		return !outside
+	}
+	return outside
+}
+
+// String returns the range as given, for perfdata.
+func (r *nagiosRange) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.spec
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// copyOpts configures copying files out of a pod.
+type copyOpts struct {
+	Pod       string
+	Container string
+	Include   []string
+	Exclude   []string
+	Quiet     bool
+}
+
+func newCopyFromCmd() *cobra.Command {
+	var opts copyOpts
+	c := &cobra.Command{
+		Use:   "copy-from NAMESPACE REMOTE_PATH LOCAL_DIR",
+		Short: "Copy files out of the wr manager or a runner pod",
+		Long: `Copies a file or directory out of a pod (the wr manager unless --pod is given)
+in to a local directory, by running tar in the container. Archive entries with
+absolute paths or .. components, and symlinks pointing outside the local
+directory, are refused. --include and --exclude take globs matched against
+paths relative to the local directory, or against file names.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			pod, err := targetPod(clientset, args[0], opts.Pod)
+			if err != nil {
+				return err
+			}
+			return copyFromPod(config, clientset, pod, &opts, args[1], args[2])
+		},
+	}
+	c.Flags().StringVarP(&opts.Pod, "pod", "p", "", "Pod to copy from (defaults to the wr manager)")
+	c.Flags().StringVarP(&opts.Container, "container", "c", "", "Container to copy from (defaults to the pod's first container)")
+	c.Flags().StringSliceVar(&opts.Include, "include", nil, "Only copy files matching these globs")
+	c.Flags().StringSliceVar(&opts.Exclude, "exclude", nil, "Don't copy files or directories matching these globs")
+	c.Flags().BoolVarP(&opts.Quiet, "quiet", "q", false, "Don't report progress")
+	return c
+}
+
+// targetPod returns the named pod, or the running wr manager pod if name is
+// empty.
+func targetPod(clientset kubernetes.Interface, namespace string, name string) (*apiv1.Pod, error) {
+	if name == "" {
+		return waitForManagerPod(clientset, namespace, false)
+	}
+	return clientset.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+}
+
+// copyFromPod copies remotePath out of a container in the pod, in to the
+// local directory dest.
+func copyFromPod(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, opts *copyOpts, remotePath string, dest string) error {
+	container := opts.Container
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+	remotePath = path.Clean(remotePath)
+	command := []string{"tar", "-cf", "-", "-C", path.Dir(remotePath), path.Base(remotePath)}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		err := execInContainer(config, clientset, pod, container, command, writer, &stderr)
+		if err != nil {
+			err = fmt.Errorf("tar in %s/%s failed: %v: %s", pod.ObjectMeta.Name, container, err, strings.TrimSpace(stderr.String()))
+		}
+		writer.CloseWithError(err)
+	}()
+
+	var progress func(files int, size int64)
+	if !opts.Quiet {
+		report := newProgressReport(os.Stderr, time.Second)
+		defer report.done()
+		progress = report.update
+	}
+	err := extractTar(reader, dest, &pathFilter{Include: opts.Include, Exclude: opts.Exclude}, progress)
+	//Make sure the exec doesn't block writing to a pipe nobody reads
+	reader.CloseWithError(err)
+	return err
+}
+
+// pathFilter decides which archive entries get extracted.
+type pathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// allows reports whether the entry with the given relative, slash separated
+// name should be extracted. Directories are only subject to the excludes, so
+// that included files inside them can still be created.
+func (f *pathFilter) allows(name string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if matchesAny(f.Exclude, p) {
+			return false
+		}
+	}
+	if isDir || len(f.Include) == 0 {
+		return true
+	}
+	return matchesAny(f.Include, name)
+}
+
+// matchesAny reports whether the name or its last element matches any of the
+// globs.
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// safeArchivePath checks an archive entry name can't escape the directory it
+// is extracted in to, returning it cleaned.
+func safeArchivePath(name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("refusing absolute path %q in archive", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("refusing path %q with .. in archive", name)
+		}
+	}
+	return path.Clean(filepath.ToSlash(name)), nil
+}
+
+// withinDest reports whether the slash separated relative path stays within
+// the destination directory.
+func withinDest(rel string) bool {
+	rel = path.Clean(rel)
+	return rel != ".." && !strings.HasPrefix(rel, "../") && !path.IsAbs(rel)
+}
+
+// checkNoSymlinks makes sure none of the directories between dest and target
+// are symlinks, so that writing target can't be redirected outside dest.
+func checkNoSymlinks(dest string, rel string) error {
+	current := dest
+	parts := strings.Split(path.Dir(rel), "/")
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write %q through symlink %q", rel, current)
+		}
+	}
+	return nil
+}
+
+// checkSymlinkTarget makes sure a symlink at rel pointing to linkname stays
+// within dest on disk, not just as text. Every .. in the target has to come
+// after a real directory: after a symlink, or something that could yet become
+// one, it climbs out of wherever that leads rather than back up the path.
+func checkSymlinkTarget(dest string, rel string, linkname string) error {
+	var parts []string
+	for _, part := range strings.Split(path.Dir(rel)+"/"+linkname, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return fmt.Errorf("refusing symlink %q -> %q pointing outside %s", rel, linkname, dest)
+			}
+			current := strings.Join(parts, "/")
+			info, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(current)))
+			if err != nil || !info.IsDir() {
+				return fmt.Errorf("refusing symlink %q -> %q with .. after %q, which isn't a directory", rel, linkname, current)
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return nil
+}
+
+// extractTar extracts the tar stream in to dest, refusing entries that would
+// end up outside of it. progress, if not nil, is called with the running
+// totals after every file.
+func extractTar(r io.Reader, dest string, filter *pathFilter, progress func(files int, size int64)) error {
+	tr := tar.NewReader(r)
+	files := 0
+	var size int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := safeArchivePath(header.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "." || !filter.allows(rel, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+		if err := checkNoSymlinks(dest, rel); err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		//Never follow whatever is already at the target
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			n, err := writeFile(target, tr, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			files++
+			size += n
+			if progress != nil {
+				progress(files, size)
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(header.Linkname) || !withinDest(path.Join(path.Dir(rel), header.Linkname)) {
+				return fmt.Errorf("refusing symlink %q -> %q pointing outside %s", rel, header.Linkname, dest)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := checkSymlinkTarget(dest, rel, header.Linkname); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkRel, err := safeArchivePath(header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := checkNoSymlinks(dest, linkRel); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(dest, filepath.FromSlash(linkRel)), target); err != nil {
+				return err
+			}
+		default:
+			//Devices, fifos and the like have no business in a copy
+			continue
+		}
+	}
+}
+
+// writeFile writes the contents of r to a new file at target.
+func writeFile(target string, r io.Reader, mode os.FileMode) (int64, error) {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// progressReport prints running totals of a copy at most once per interval.
+type progressReport struct {
+	out      io.Writer
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	files    int
+	size     int64
+}
+
+// newProgressReport returns a progressReport writing to out.
+func newProgressReport(out io.Writer, interval time.Duration) *progressReport {
+	now := time.Now()
+	return &progressReport{out: out, interval: interval, start: now, last: now}
+}
+
+// update records new totals, printing them if it's been long enough.
+func (p *progressReport) update(files int, size int64) {
+	p.files, p.size = files, size
+	if time.Since(p.last) >= p.interval {
+		p.print()
+		p.last = time.Now()
+	}
+}
+
+// done prints the final totals.
+func (p *progressReport) done() {
+	p.print()
+	fmt.Fprintln(p.out)
+}
+
+func (p *progressReport) print() {
+	fmt.Fprintf(p.out, "\rcopied %d files, %.1f MB in %s", p.files, float64(p.size)/(1024*1024), time.Since(p.start).Round(time.Second))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// execInContainer runs a command in a container of a pod, copying its output
+// to stdout and stderr (either of which may be nil). A non-zero exit status is
+// returned as a k8s.io/client-go/util/exec.ExitError.
+func execInContainer(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, container string, command []string, stdout io.Writer, stderr io.Writer) error {
+	return execWithStdin(config, clientset, pod, container, command, nil, stdout, stderr)
+}
+
+// execWithStdin is execInContainer with the command's input read from stdin,
+// if not nil.
+func execWithStdin(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, container string, command []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	_, err := podexec.Run(config, clientset, podexec.Options{
+		Namespace: pod.ObjectMeta.Namespace,
+		Pod:       pod.ObjectMeta.Name,
+		Container: container,
+		Command:   command,
+		Stdin:     stdin,
+		Stdout:    stdout,
+		Stderr:    stderr,
+		Transport: execTransport,
+	})
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fanOutOpts configures copying files in to many pods at once.
+type fanOutOpts struct {
+	Selector  string
+	Pods      []string
+	Container string
+	Dest      string
+	Parallel  int
+	// ReplaceDirs lets a directory in Dest in the way of a file be removed.
+	ReplaceDirs bool
+	Transfer    transferOpts
+}
+
+// fanOutResult is the outcome of copying in to one pod.
+type fanOutResult struct {
+	Pod      string
+	Attempts int
+	Took     time.Duration
+	Err      error
+}
+
+func newCopyToCmd() *cobra.Command {
+	var opts fanOutOpts
+	c := &cobra.Command{
+		Use:   "copy-to NAMESPACE LOCAL_FILE...",
+		Short: "Copy files in to many pods at once",
+		Long: `Copies local files in to a container of every running pod matching --selector,
+or of each --pod, up to --parallel pods at a time. Each pod is sent the same
+tarball, compressed once, unpacked in to a staging directory of its own and
+renamed in to --dest once complete (failing if a directory is in the way of a
+file, unless --replace-dirs is given), and a failed copy is retried from
+scratch up to --copy-retries times. A table of the results is printed at the
+end, and the command fails if any pod was not copied to.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.validate(); err != nil {
+				return err
+			}
+			files, err := localFiles(args[1:])
+			if err != nil {
+				return err
+			}
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			pods, err := fanOutPods(clientset, args[0], &opts)
+			if err != nil {
+				return err
+			}
+			p, err := newPayload(files, opts.Transfer.Compression)
+			if err != nil {
+				return err
+			}
+			defer p.Close()
+			results := copyToPods(config, clientset, pods, p, &opts)
+			printFanOutResults(results, os.Stdout)
+			failed := 0
+			for _, result := range results {
+				if result.Err != nil {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("copy failed for %d of %d pods", failed, len(results))
+			}
+			return nil
+		},
+	}
+	c.Flags().StringVarP(&opts.Selector, "selector", "l", "", "Label selector of the pods to copy to")
+	c.Flags().StringSliceVarP(&opts.Pods, "pod", "p", nil, "Pods to copy to")
+	c.Flags().StringVarP(&opts.Container, "container", "c", "", "Container to copy in to (defaults to each pod's first container)")
+	c.Flags().StringVar(&opts.Dest, "dest", "/tmp", "Directory in the container to copy in to")
+	c.Flags().IntVar(&opts.Parallel, "parallel", 10, "Number of pods to copy to at once")
+	c.Flags().BoolVar(&opts.ReplaceDirs, "replace-dirs", false, "Remove a directory in --dest that's in the way of a file being copied, instead of failing")
+	opts.Transfer.addFlags(c)
+	return c
+}
+
+// validate checks the options make sense.
+func (o *fanOutOpts) validate() error {
+	if (o.Selector == "") == (len(o.Pods) == 0) {
+		return fmt.Errorf("give one of --selector or --pod")
+	}
+	if o.Parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	if !path.IsAbs(o.Dest) {
+		return fmt.Errorf("--dest must be an absolute path")
+	}
+	return o.Transfer.validate()
+}
+
+// localFiles maps the base names of the given local files to their paths,
+// checking they are all regular files with distinct names.
+func localFiles(paths []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, local := range paths {
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", local)
+		}
+		name := filepath.Base(local)
+		if other, exists := files[name]; exists {
+			return nil, fmt.Errorf("%s and %s would both be copied to %s", other, local, name)
+		}
+		files[name] = local
+	}
+	return files, nil
+}
+
+// fanOutPods returns the pods to copy to: the running pods matching the
+// selector, or the named pods.
+func fanOutPods(clientset kubernetes.Interface, namespace string, opts *fanOutOpts) ([]apiv1.Pod, error) {
+	if opts.Selector == "" {
+		var pods []apiv1.Pod
+		for _, name := range opts.Pods {
+			pod, err := clientset.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, *pod)
+		}
+		return pods, nil
+	}
+	podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: opts.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []apiv1.Pod
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == apiv1.PodRunning {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no running pods match %q in namespace %s", opts.Selector, namespace)
+	}
+	return pods, nil
+}
+
+// copyToPods sends the payload to every pod, at most opts.Parallel at a
+// time, returning a result for each pod in the same order.
+func copyToPods(config *rest.Config, clientset kubernetes.Interface, pods []apiv1.Pod, p *payload, opts *fanOutOpts) []fanOutResult {
+	results := make([]fanOutResult, len(pods))
+	slots := make(chan struct{}, opts.Parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	finished := 0
+	extract := func(compression string, size int64) []string {
+		return copyToCommand(opts.Dest, compression, size, opts.ReplaceDirs)
+	}
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			pod := &pods[i]
+			container := opts.Container
+			if container == "" {
+				container = pod.Spec.Containers[0].Name
+			}
+			start := time.Now()
+			attempts, err := sendFiles(config, clientset, pod, container, p, extract, &opts.Transfer, nil)
+			results[i] = fanOutResult{Pod: pod.ObjectMeta.Name, Attempts: attempts, Took: time.Since(start), Err: err}
+			if opts.Transfer.Progress {
+				mu.Lock()
+				finished++
+				fmt.Fprintf(os.Stderr, "%d/%d pods done\n", finished, len(pods))
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// printFanOutResults writes a table of the results of a fan-out copy.
+func printFanOutResults(results []fanOutResult, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tRESULT\tATTEMPTS\tTOOK\tERROR")
+	for _, result := range results {
+		status, errMsg := "copied", ""
+		if result.Err != nil {
+			status, errMsg = "failed", result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", result.Pod, status, result.Attempts, result.Took.Round(time.Millisecond), errMsg)
+	}
+	w.Flush()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// wrNamespaceInfo is what the janitor knows about a namespace created by the
+// deployer.
+type wrNamespaceInfo struct {
+	Name           string
+	Owner          string
+	Created        time.Time
+	Expiry         time.Time
+	HasTTL         bool
+	ManagerRunning bool
+}
+
+// Expired reports whether the namespace has outlived its ttl.
+func (n wrNamespaceInfo) Expired(now time.Time) bool {
+	return n.HasTTL && now.After(n.Expiry)
+}
+
+func newJanitorCmd() *cobra.Command {
+	var unattended bool
+	var interval time.Duration
+	c := &cobra.Command{
+		Use:   "janitor",
+		Short: "Report on wr namespaces and delete the ones past their ttl",
+		Long: `Lists every namespace created by the deployer across the cluster, reporting
+its owner, age, ttl and whether a wr manager is still running in it.
+Namespaces past their ttl are deleted once you confirm, or straight away with
+--yes. With --interval the janitor keeps running, checking again after each
+interval; this requires --yes.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if interval > 0 && !unattended {
+				return fmt.Errorf("--interval can only be used together with --yes")
+			}
+			_, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			for {
+				if err := runJanitor(clientset, os.Stdout, unattended); err != nil {
+					if interval == 0 {
+						return err
+					}
+					fmt.Fprintf(os.Stderr, "janitor run failed: %v\n", err)
+				}
+				if interval == 0 {
+					return nil
+				}
+				time.Sleep(interval)
+			}
+		},
+	}
+	c.Flags().BoolVarP(&unattended, "yes", "y", false, "Delete expired namespaces without asking for confirmation")
+	c.Flags().DurationVar(&interval, "interval", 0, "Run repeatedly, waiting this long between runs (requires --yes)")
+	return c
+}
+
+// runJanitor reports on every namespace created by the deployer and deletes
+// the expired ones, asking first unless unattended is set.
+func runJanitor(clientset kubernetes.Interface, out io.Writer, unattended bool) error {
+	namespaces, err := listWrNamespaces(clientset)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	printNamespaces(out, namespaces, now)
+
+	var expired []string
+	for _, ns := range namespaces {
+		if ns.Expired(now) {
+			expired = append(expired, ns.Name)
+		}
+	}
+	if len(expired) == 0 {
+		fmt.Fprintln(out, "No expired namespaces.")
+		return nil
+	}
+	if !unattended && !confirm(fmt.Sprintf("Delete %d expired namespace(s): %s?", len(expired), strings.Join(expired, ", "))) {
+		fmt.Fprintln(out, "Nothing deleted.")
+		return nil
+	}
+	for _, name := range expired {
+		if err := clientset.CoreV1().Namespaces().Delete(name, &metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %v", name, err)
+		}
+		fmt.Fprintf(out, "Deleted namespace %s\n", name)
+	}
+	return nil
+}
+
+// listWrNamespaces finds every namespace created by the deployer, and checks
+// whether a wr manager is running in each.
+func listWrNamespaces(clientset kubernetes.Interface) ([]wrNamespaceInfo, error) {
+	nsList, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{
+		LabelSelector: managedSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wr namespaces: %v", err)
+	}
+	infos := make([]wrNamespaceInfo, 0, len(nsList.Items))
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		info := wrNamespaceInfo{
+			Name:    ns.ObjectMeta.Name,
+			Owner:   ns.ObjectMeta.Labels[ownerLabel],
+			Created: ns.ObjectMeta.CreationTimestamp.Time,
+		}
+		info.Expiry, info.HasTTL = namespaceExpiry(ns)
+		//A namespace already being deleted has nothing left to look after.
+		if ns.Status.Phase != apiv1.NamespaceTerminating {
+			info.ManagerRunning, err = managerRunning(clientset, ns.ObjectMeta.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// managerRunning reports whether a wr manager pod is running in the given
+// namespace.
+func managerRunning(clientset kubernetes.Interface, namespace string) (bool, error) {
+	pod, err := runningManagerPod(clientset, namespace)
+	return pod != nil, err
+}
+
+// runningManagerPod returns the running wr manager pod in the given namespace,
+// or nil if there isn't one.
+func runningManagerPod(clientset kubernetes.Interface, namespace string) (*apiv1.Pod, error) {
+	podList, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: managerSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods in namespace %s: %v", namespace, err)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if pod.Status.Phase == apiv1.PodRunning && pod.ObjectMeta.DeletionTimestamp == nil {
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+// printNamespaces writes a table describing the given namespaces.
+func printNamespaces(out io.Writer, namespaces []wrNamespaceInfo, now time.Time) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tOWNER\tAGE\tEXPIRES\tMANAGER")
+	for _, ns := range namespaces {
+		expires := "never"
+		switch {
+		case ns.Expired(now):
+			expires = "expired"
+		case ns.HasTTL:
+			expires = "in " + ns.Expiry.Sub(now).Round(time.Second).String()
+		}
+		manager := "none"
+		if ns.ManagerRunning {
+			manager = "running"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ns.Name, ns.Owner, now.Sub(ns.Created).Round(time.Second), expires, manager)
+	}
+	w.Flush()
+}
+
+// confirm asks the user a yes/no question on stdin, defaulting to no.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+	return answer == "y" || answer == "yes"
+}
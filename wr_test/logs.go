@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Sources a log line can come from.
+const (
+	sourceContainer = "container"
+	sourceFile      = "logfile"
+)
+
+// logTimeFormat is how the time of each line is shown.
+const logTimeFormat = "2006-01-02 15:04:05.000"
+
+// logsOpts configures the logs command.
+type logsOpts struct {
+	Follow    bool
+	Container bool
+	File      bool
+	Tail      int64
+}
+
+// logLine is a single line of output from the manager, with the time it was
+// written (for container output) or received (for the log file).
+type logLine struct {
+	Time   time.Time
+	Source string
+	Text   string
+}
+
+func newLogsCmd() *cobra.Command {
+	var opts logsOpts
+	var containerOnly, fileOnly bool
+	c := &cobra.Command{
+		Use:   "logs NAMESPACE",
+		Short: "Show the wr manager's container output and its log file",
+		Long: `Shows the stdout and stderr of the wr manager container along with the
+manager's own log file (managerlogfile), interleaved and timestamped. With
+--follow it keeps going across manager restarts, finding the new manager pod
+by its label.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if containerOnly && fileOnly {
+				return fmt.Errorf("--container-only and --file-only can't be used together")
+			}
+			opts.Container = !fileOnly
+			opts.File = !containerOnly
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			wrConf, err := loadWrConfig(wrConfigPath)
+			if err != nil {
+				return err
+			}
+			return managerLogs(config, clientset, args[0], wrConf.managerFile(wrConf.ManagerLogFile), &opts, os.Stdout)
+		},
+	}
+	c.Flags().BoolVarP(&opts.Follow, "follow", "f", false, "Keep streaming new output, surviving manager restarts")
+	c.Flags().Int64Var(&opts.Tail, "tail", 10, "Number of existing lines to show from each source (-1 for all)")
+	c.Flags().BoolVar(&containerOnly, "container-only", false, "Only show the container's stdout and stderr")
+	c.Flags().BoolVar(&fileOnly, "file-only", false, "Only show the manager's log file")
+	return c
+}
+
+// How long managerLogs waits before looking at the manager again after
+// failing to read its logs, or losing the pod straight away. The wait doubles
+// each time up to the maximum, so a manager that keeps failing isn't hammered.
+const (
+	minLogRetry = time.Second
+	maxLogRetry = 30 * time.Second
+)
+
+// logError is a failure to read one of the manager's logs.
+type logError struct {
+	Source string
+	Err    error
+	// Permanent is set if trying again would fail the same way, eg. because
+	// we aren't allowed to read the logs or tail failed.
+	Permanent bool
+}
+
+func (e *logError) Error() string {
+	return fmt.Sprintf("failed to read %s: %v", e.Source, e.Err)
+}
+
+// newLogError returns a logError for the source, working out whether err is
+// permanent.
+func newLogError(source string, err error) *logError {
+	cause := err
+	if streamErr, ok := err.(*podexec.StreamError); ok {
+		cause = streamErr.Err
+	}
+	return &logError{
+		Source: source,
+		Err:    err,
+		Permanent: podexec.IsCommandFailure(err) ||
+			apierrors.IsForbidden(cause) ||
+			apierrors.IsUnauthorized(cause) ||
+			apierrors.IsBadRequest(cause),
+	}
+}
+
+// managerLogs writes the output of the wr manager in the given namespace to
+// out. When following, it waits for a new manager pod whenever the current one
+// goes away, carrying on from the last container output it saw. It gives up
+// if reading a log fails in a way that won't get better.
+func managerLogs(config *rest.Config, clientset kubernetes.Interface, namespace string, logFile string, opts *logsOpts, out io.Writer) error {
+	var since *metav1.Time
+	tail := opts.Tail
+	retry := minLogRetry
+	for {
+		pod, err := waitForManagerPod(clientset, namespace, opts.Follow)
+		if err != nil {
+			return err
+		}
+		lines := make(chan logLine)
+		errs := make(chan *logError, 2)
+		var wg sync.WaitGroup
+		if opts.Container {
+			wg.Add(1)
+			go func(since *metav1.Time, tail int64) {
+				defer wg.Done()
+				if err := containerLog(clientset, pod, since, tail, opts.Follow, lines); err != nil {
+					errs <- newLogError(sourceContainer, err)
+				}
+			}(since, tail)
+		}
+		if opts.File {
+			wg.Add(1)
+			go func(tail int64) {
+				defer wg.Done()
+				if err := fileLog(config, clientset, pod, logFile, tail, opts.Follow, lines); err != nil {
+					errs <- newLogError(sourceFile, err)
+				}
+			}(tail)
+		}
+		go func() {
+			wg.Wait()
+			close(lines)
+			close(errs)
+		}()
+		sawLines := false
+		for line := range lines {
+			sawLines = true
+			fmt.Fprintf(out, "%s [%s] %s\n", line.Time.Local().Format(logTimeFormat), line.Source, line.Text)
+			if line.Source == sourceContainer {
+				t := metav1.NewTime(line.Time.Add(time.Nanosecond))
+				since = &t
+			}
+		}
+		var failure *logError
+		for err := range errs {
+			if failure == nil || err.Permanent {
+				failure = err
+			}
+		}
+		if failure != nil && (failure.Permanent || !opts.Follow) {
+			return failure
+		}
+		if !opts.Follow {
+			return nil
+		}
+		//Everything from a replacement container is new to us
+		tail = -1
+		if failure == nil && sawLines {
+			retry = minLogRetry
+			fmt.Fprintf(os.Stderr, "Lost manager pod %s, looking for its replacement...\n", pod.ObjectMeta.Name)
+			continue
+		}
+		if failure != nil {
+			fmt.Fprintf(os.Stderr, "%v; trying again in %s...\n", failure, retry)
+		} else {
+			fmt.Fprintf(os.Stderr, "Lost manager pod %s, looking again in %s...\n", pod.ObjectMeta.Name, retry)
+		}
+		time.Sleep(retry)
+		if retry *= 2; retry > maxLogRetry {
+			retry = maxLogRetry
+		}
+	}
+}
+
+// waitForManagerPod returns the running manager pod in the namespace. If block
+// is set it waits for one to appear, otherwise it's an error if there's none.
+func waitForManagerPod(clientset kubernetes.Interface, namespace string, block bool) (*apiv1.Pod, error) {
+	pod, err := runningManagerPod(clientset, namespace)
+	if err != nil || pod != nil {
+		return pod, err
+	}
+	if !block {
+		return nil, fmt.Errorf("no wr manager running in namespace %s", namespace)
+	}
+	err = wait.PollImmediateInfinite(2*time.Second, func() (bool, error) {
+		pod, err = runningManagerPod(clientset, namespace)
+		return pod != nil, err
+	})
+	return pod, err
+}
+
+// containerLog sends the stdout and stderr of the manager container to lines.
+func containerLog(clientset kubernetes.Interface, pod *apiv1.Pod, since *metav1.Time, tail int64, follow bool, lines chan<- logLine) error {
+	logOpts := &apiv1.PodLogOptions{
+		Container:  "wr-manager",
+		Follow:     follow,
+		Timestamps: true,
+		SinceTime:  since,
+	}
+	if tail >= 0 && since == nil {
+		logOpts.TailLines = &tail
+	}
+	stream, err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).GetLogs(pod.ObjectMeta.Name, logOpts).Stream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	return scanLines(stream, sourceContainer, true, lines)
+}
+
+// fileLog sends the lines of the manager's log file to lines, by running tail
+// in the manager container. If tail fails the error is the one from podexec,
+// so callers can tell how it failed.
+func fileLog(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, logFile string, tail int64, follow bool, lines chan<- logLine) error {
+	command := []string{"tail"}
+	if follow {
+		//-F keeps going if wr rotates or recreates its log file
+		command = append(command, "-F")
+	}
+	if tail < 0 {
+		command = append(command, "-n", "+1")
+	} else {
+		command = append(command, "-n", strconv.FormatInt(tail, 10))
+	}
+	command = append(command, logFile)
+
+	reader, writer := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		err := execInContainer(config, clientset, pod, "wr-manager", command, writer, &stderr)
+		if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+			lines <- logLine{Time: time.Now(), Source: sourceFile, Text: msg}
+		}
+		writer.CloseWithError(err)
+	}()
+	return scanLines(reader, sourceFile, false, lines)
+}
+
+// scanLines sends each line read from r to lines. If timestamped is set each
+// line starts with an RFC3339 timestamp, as given by the pod log API;
+// otherwise lines are stamped with the time they were read.
+func scanLines(r io.Reader, source string, timestamped bool, lines chan<- logLine) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := logLine{Time: time.Now(), Source: source, Text: scanner.Text()}
+		if timestamped {
+			parts := strings.SplitN(line.Text, " ", 2)
+			if t, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+				line.Time = t
+				line.Text = ""
+				if len(parts) == 2 {
+					line.Text = parts[1]
+				}
+			}
+		}
+		lines <- line
+	}
+	return scanner.Err()
+}
@@ -4,44 +4,49 @@ import (
 	"archive/tar"
 	"bufio"
 	//"errors"
-	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
-	"strings"
+	"sort"
 	"time"
 
-	"github.com/docker/docker/pkg/namesgenerator"
+	"github.com/spf13/cobra"
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/client-go/util/retry"
 	// Uncomment the following line to load the gcp plugin (only required to authenticate against GKE clusters).
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
-type Writer struct {
-	Str []string
-}
+// kubeconfig is the path to the kubeconfig file shared by every subcommand.
+var kubeconfig string
 
-func (w *Writer) Write(p []byte) (n int, err error) {
-	str := string(p)
-	if len(str) > 0 {
-		w.Str = append(w.Str, str)
-	}
-	return len(str), nil
-}
+// wrConfigPath is the wr config file the deployment's settings are taken from.
+var wrConfigPath string
+
+// execTransport is how exec and attach streams talk to the API server.
+var execTransport string
+
+// managerSelector selects the wr manager pod within a deployment's namespace.
+const managerSelector = "app=wr-manager"
+
+// Ports the wr manager listens on inside its pod.
+const (
+	managerPort int32 = 1021
+	webPort     int32 = 1022
+)
 
-func addFile(tw *tar.Writer, fpath string, dest string) error {
+func addFile(tw *tar.Writer, fpath string, name string) error {
 	file, err := os.Open(fpath)
 	if err != nil {
 		return err
@@ -50,7 +55,7 @@ func addFile(tw *tar.Writer, fpath string, dest string) error {
 	if stat, err := file.Stat(); err == nil {
 		// now lets create the header as needed for this file within the tarball
 		header := new(tar.Header)
-		header.Name = dest + path.Base(fpath)
+		header.Name = name
 		header.Size = stat.Size()
 		header.Mode = int64(stat.Mode())
 		header.ModTime = stat.ModTime()
@@ -66,59 +71,152 @@ func addFile(tw *tar.Writer, fpath string, dest string) error {
 	return nil
 }
 
-func makeTar(files []string, destDir string, writer io.Writer) error {
+// makeTar writes a tarball of the given files, a map of name within destDir
+// to local path, to writer.
+func makeTar(files map[string]string, destDir string, writer io.Writer) error {
 	//Set up tar writer
 	tarWriter := tar.NewWriter(writer)
-	defer tarWriter.Close()
-	//Add each file to the tarball
-	for i := range files {
-		if err := addFile(tarWriter, path.Clean(files[i]), destDir); err != nil {
-			panic(err)
+	//Add each file to the tarball, in a stable order
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addFile(tarWriter, path.Clean(files[name]), destDir+name); err != nil {
+			return err
 		}
 	}
-	return nil
+	return tarWriter.Close()
 }
 
 func main() {
+	rootCmd := &cobra.Command{
+		Use:   "wr_test",
+		Short: "Deploy and look after wr managers running in a Kubernetes cluster",
+	}
 	//Obtain cluster authentication information from users home directory, or fall back to user input.
-	var kubeconfig *string
 	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+		rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
 	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+		rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	}
-	flag.Parse()
+	rootCmd.PersistentFlags().StringVar(&wrConfigPath, "wr-config", "wr_config.yml", "wr config file to take manager settings from")
+	rootCmd.PersistentFlags().StringVar(&execTransport, "transport", podexec.TransportAuto, "How to stream exec and attach: spdy, websocket, or auto to use websocket when SPDY can't get through")
+	rootCmd.AddCommand(newDeployCmd(), newStatusCmd(), newLogsCmd(), newShellCmd(), newCopyFromCmd(), newCopyToCmd(), newBackupCmd(), newCheckCmd(), newBatchExecCmd(), newJanitorCmd())
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
 
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+// authenticate builds a rest config from the kubeconfig flag, and a clientset
+// authenticated against the cluster it points at.
+func authenticate() (*rest.Config, *kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	fmt.Println(reflect.TypeOf(config))
-	//Create authenticated clientset
 	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, clientset, nil
+}
+
+// deployOpts holds the options given to the deploy command.
+type deployOpts struct {
+	TTL      time.Duration
+	Quota    quotaOpts
+	Network  netpolOpts
+	Service  serviceOpts
+	Probes   probeOpts
+	Binary   binaryOpts
+	Transfer transferOpts
+	// RestoreFrom is a local database backup to seed the manager with.
+	RestoreFrom string
+}
+
+func newDeployCmd() *cobra.Command {
+	var opts deployOpts
+	c := &cobra.Command{
+		Use:   "deploy",
+		Short: "Create a new namespace and start a wr manager in it",
+		Run: func(cmd *cobra.Command, args []string) {
+			deploy(&opts)
+		},
+	}
+	c.Flags().DurationVar(&opts.TTL, "ttl", 0, "How long the namespace may live before the janitor deletes it (0 means forever)")
+	opts.Quota.addFlags(c)
+	opts.Network.addFlags(c)
+	opts.Service.addFlags(c)
+	opts.Probes.addFlags(c)
+	opts.Binary.addFlags(c)
+	opts.Transfer.addFlags(c)
+	c.Flags().StringVar(&opts.RestoreFrom, "restore-from", "", "Database backup to start the manager with")
+	return c
+}
+
+func deploy(opts *deployOpts) {
+	config, clientset, err := authenticate()
 	if err != nil {
 		panic(err)
 	}
+	fmt.Println(reflect.TypeOf(config))
 	fmt.Println(reflect.TypeOf(clientset))
-	//Create a unique namespace
-	namespaceClient := clientset.CoreV1().Namespaces()
-	fmt.Println(reflect.TypeOf(namespaceClient))
-	newNamespace := strings.Replace(namesgenerator.GetRandomName(0), "_", "-", -1) + "-wr"
-	//Retry if namespace taken
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		_, nsErr := namespaceClient.Create(&apiv1.Namespace{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: newNamespace,
-			},
-		})
-		if nsErr != nil {
-			fmt.Printf("Failed to create new namespace, %s. Trying again. Error: %v", newNamespace, err)
-			newNamespace = strings.Replace(namesgenerator.GetRandomName(0), "_", "-", -1) + "-wr"
+	wrConf, err := loadWrConfig(wrConfigPath)
+	if err != nil {
+		panic(fmt.Errorf("Failed to read wr config %s: %v", wrConfigPath, err))
+	}
+	//Check the options make sense before we create anything
+	if opts.Network.Enabled {
+		if _, err := opts.Network.networkPolicies(); err != nil {
+			panic(err)
+		}
+	}
+	if err := opts.Service.validate(); err != nil {
+		panic(err)
+	}
+	if err := opts.Binary.validate(); err != nil {
+		panic(err)
+	}
+	if err := opts.Transfer.validate(); err != nil {
+		panic(err)
+	}
+	if opts.RestoreFrom != "" {
+		if opts.Binary.Source != binaryFromAttach {
+			panic(fmt.Errorf("--restore-from needs --binary-source=attach to send the backup"))
+		}
+		if opts.Probes.UsableTimeout == 0 {
+			panic(fmt.Errorf("--restore-from needs a --usable-timeout to check the restore worked"))
+		}
+		if err := checkRestoreFile(opts.RestoreFrom); err != nil {
+			panic(fmt.Errorf("Can't restore from %s: %v", opts.RestoreFrom, err))
+		}
+	}
+	if opts.Service.external() && opts.Service.TLSSecret == "" {
+		fmt.Println("Warning: exposing the wr web interface outside the cluster without TLS")
+	}
+	//Create a unique namespace, labelled so the janitor can find it later
+	newNamespace, err := createNamespace(clientset, opts.TTL)
+	if err != nil {
+		panic(fmt.Errorf("Creatioin of namespace failed: %v", err))
+	}
+	if opts.Quota.Enabled {
+		if err := createQuota(clientset, newNamespace, &opts.Quota, wrConf); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Created quota %q and limit range %q.\n", quotaName, limitRangeName)
+	}
+	if opts.Network.Enabled {
+		if err := createNetworkPolicies(clientset, newNamespace, &opts.Network); err != nil {
+			panic(err)
+		}
+		fmt.Println("Created network policies.")
+	}
+	if opts.Service.TLSSecret != "" {
+		if err := copyTLSSecret(clientset, opts.Service.TLSSecret, newNamespace); err != nil {
+			panic(err)
 		}
-		return nsErr
-	})
-	if retryErr != nil {
-		panic(fmt.Errorf("Creatioin of namespace failed: %v", retryErr))
 	}
 
 	//Create clientset for deployments that is authenticated against the given cluster. Use default namsespace.
@@ -126,7 +224,125 @@ func main() {
 
 	fmt.Println(reflect.TypeOf(deploymentsClient))
 	//Create new wr deployment
-	deployment := &appsv1beta1.Deployment{
+	deployment := managerDeployment()
+
+	if opts.Service.TLSSecret != "" {
+		addTLS(&deployment.Spec.Template.Spec)
+	}
+	opts.Probes.addProbes(&deployment.Spec.Template.Spec.Containers[0], opts.Service.TLSSecret != "")
+	opts.Binary.fetchInitContainer(&deployment.Spec.Template.Spec, "wr-temp", "/wr-tmp")
+	if opts.RestoreFrom != "" {
+		restoreDb(&deployment.Spec.Template.Spec.Containers[0], "/wr-tmp", wrConf.managerFile(wrConf.ManagerDbFile))
+	}
+
+	// Create Deployment
+	fmt.Println("Creating deployment...")
+	result, err := deploymentsClient.Create(deployment)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Created deployment %q in namespace %v.\n", result.GetObjectMeta().GetName(), newNamespace)
+	if err := exposeManager(clientset, newNamespace, &opts.Service); err != nil {
+		panic(err)
+	}
+
+	//Copy WR to pod, selecting by label.
+	//Wait for the pod to be created, then return it
+	var podList *apiv1.PodList
+	getPodErr := wait.ExponentialBackoff(retry.DefaultRetry, func() (done bool, err error) {
+		var getErr error
+		podList, getErr = clientset.CoreV1().Pods(newNamespace).List(metav1.ListOptions{
+			LabelSelector: managerSelector,
+		})
+		switch {
+		case getErr != nil:
+			panic(fmt.Errorf("Failed to list pods in namespace %v \n", newNamespace))
+		case len(podList.Items) == 0:
+			return false, nil
+		case len(podList.Items) > 0:
+			return true, nil
+		default:
+			return false, err
+		}
+	})
+	if getPodErr != nil {
+		panic(fmt.Errorf("Failed to list pods, error: %v\n", getPodErr))
+
+	}
+
+	pod := podList.Items[0]
+	fmt.Printf("Pod has name %v, in namespace %v\n", pod.ObjectMeta.Name, pod.ObjectMeta.Namespace)
+	if opts.Binary.Source == binaryFromAttach {
+		//Pick the binary built for the node the pod landed on
+		node, err := scheduledNode(clientset, &pod, 5*time.Minute)
+		if err != nil {
+			panic(err)
+		}
+		binary, err := opts.Binary.binaryFor(node)
+		if err != nil {
+			panic(fmt.Errorf("Not copying wr to pod %s in namespace %s: %v", pod.ObjectMeta.Name, newNamespace, err))
+		}
+		fmt.Printf("Pod is on node %s, copying %s\n", node.ObjectMeta.Name, binary)
+		files := map[string]string{"wr": binary}
+		if opts.RestoreFrom != "" {
+			files[restoreFileName] = opts.RestoreFrom
+		}
+
+		//Copy the wr binary to the running pod
+		fmt.Println("Sleeping for 15s") // wait for container to be running
+		time.Sleep(15 * time.Second)
+		fmt.Println("Woken up")
+		fmt.Printf("Container for pod is %v\n", pod.Spec.InitContainers[0].Name)
+		var progress transferProgress
+		if opts.Transfer.Progress {
+			progress = printTransferProgress(os.Stdout)
+		}
+		initExtract := func(compression string, size int64) []string {
+			return extractCommand("/wr-tmp", compression, size)
+		}
+		stream, err := newPayload(files, opts.Transfer.Compression)
+		if err != nil {
+			panic(err)
+		}
+		_, err = sendFiles(config, clientset, &pod, pod.Spec.InitContainers[0].Name, stream, initExtract, &opts.Transfer, progress)
+		stream.Close()
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		fmt.Printf("Init container is fetching wr from %s\n", opts.Binary.location())
+	}
+
+	if opts.Probes.UsableTimeout > 0 {
+		fmt.Println("Waiting for the manager to become usable...")
+		if err := waitUsable(config, clientset, newNamespace, pod.ObjectMeta.Name, opts.Probes.UsableTimeout); err != nil {
+			panic(err)
+		}
+		fmt.Println("Manager is up.")
+	}
+	if opts.RestoreFrom != "" {
+		status, err := managerStatus(config, clientset, &pod)
+		if err != nil {
+			panic(err)
+		}
+		jobs := countJobs(status)
+		if jobs == 0 {
+			panic(fmt.Errorf("Manager started but reports no jobs; restoring from %s failed", opts.RestoreFrom))
+		}
+		fmt.Printf("Manager restored from %s with %d jobs.\n", opts.RestoreFrom, jobs)
+	}
+
+	url, err := managerURL(clientset, newNamespace, &opts.Service)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("wr web interface: %s\n", url)
+}
+
+// managerDeployment returns the deployment running the wr manager, before
+// the options are applied to it.
+func managerDeployment() *appsv1beta1.Deployment {
+	return &appsv1beta1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "wr-manager",
 		},
@@ -134,10 +350,8 @@ func main() {
 			Replicas: int32Ptr(1),
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: "wr-manager",
-					Labels: map[string]string{
-						"app": "wr-manager",
-					},
+					Name:   "wr-manager",
+					Labels: managerLabels,
 				},
 				Spec: apiv1.PodSpec{
 					Volumes: []apiv1.Volume{
@@ -156,12 +370,12 @@ func main() {
 								{
 									Name:          "wr-manager",
 									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 1021,
+									ContainerPort: managerPort,
 								},
 								{
 									Name:          "wr-web",
 									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 1022,
+									ContainerPort: webPort,
 								},
 							},
 							Command: []string{
@@ -185,11 +399,9 @@ func main() {
 					},
 					InitContainers: []apiv1.Container{
 						{
-							Name:      "init-container",
-							Image:     "ubuntu:17.10",
-							Command:   []string{"/bin/tar", "-xf", "-"},
-							Stdin:     true,
-							StdinOnce: true,
+							Name:    "init-container",
+							Image:   "ubuntu:17.10",
+							Command: waitForCopyCommand("/wr-tmp"),
 							VolumeMounts: []apiv1.VolumeMount{
 								{
 									Name:      "wr-temp",
@@ -203,113 +415,6 @@ func main() {
 			},
 		},
 	}
-
-	// Create Deployment
-	fmt.Println("Creating deployment...")
-	result, err := deploymentsClient.Create(deployment)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Printf("Created deployment %q in namespace %v.\n", result.GetObjectMeta().GetName(), newNamespace)
-
-	//Copy WR to pod, selecting by label.
-	//Wait for the pod to be created, then return it
-	var podList *apiv1.PodList
-	getPodErr := wait.ExponentialBackoff(retry.DefaultRetry, func() (done bool, err error) {
-		var getErr error
-		podList, getErr = clientset.CoreV1().Pods(newNamespace).List(metav1.ListOptions{
-			LabelSelector: "app=wr-manager",
-		})
-		switch {
-		case getErr != nil:
-			panic(fmt.Errorf("Failed to list pods in namespace %v \n", newNamespace))
-		case len(podList.Items) == 0:
-			return false, nil
-		case len(podList.Items) > 0:
-			return true, nil
-		default:
-			return false, err
-		}
-	})
-	if getPodErr != nil {
-		panic(fmt.Errorf("Failed to list pods, error: %v\n", getPodErr))
-
-	}
-
-	//Get the current working directory.
-	dir, err := os.Getwd()
-	if err != nil {
-		panic(err)
-	}
-
-	//Set up new pipe
-	reader, writer := io.Pipe()
-	//Read file from disk
-	//dat, err := ioutil.ReadFile(dir + "/wr")
-	//if err != nil {
-	//panic(fmt.Errorf("Failed to read binary: %v", err))
-	//}
-
-	go func() { //avoid deadlock by using goroutine
-		defer writer.Close()
-		err := makeTar([]string{dir + "/wr"}, "/wr-tmp/", writer)
-		if err != nil {
-			panic(err)
-		}
-	}()
-
-	//Copy the wr binary to the running pod
-	fmt.Println("Sleeping for 15s") // wait for container to be running
-	time.Sleep(15 * time.Second)
-	fmt.Println("Woken up")
-	pod := podList.Items[0]
-	fmt.Printf("Container for pod is %v\n", pod.Spec.InitContainers[0].Name)
-	fmt.Println(pod.Spec.InitContainers)
-	fmt.Printf("Pod has name %v, in namespace %v\n", pod.ObjectMeta.Name, pod.ObjectMeta.Namespace)
-
-	//Make a request to the APIServer for an 'attach'.
-	//Open Stdin and Stderr for use by the client
-	execRequest := clientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(pod.ObjectMeta.Name).
-		Namespace(pod.ObjectMeta.Namespace).
-		SubResource("attach")
-	execRequest.VersionedParams(&apiv1.PodExecOptions{
-		Container: pod.Spec.InitContainers[0].Name,
-		//Command:   command,
-		Stdin:  true,
-		Stdout: false,
-		Stderr: true,
-		TTY:    false,
-	}, scheme.ParameterCodec)
-
-	//Create an executor to send commands / recieve output.
-	//SPDY Allows multiplexed bidirectional streams to and from  the pod
-	exec, err := remotecommand.NewSPDYExecutor(config, "POST", execRequest.URL())
-	if err != nil {
-		panic(fmt.Errorf("Error creating SPDYExecutor: %v", err))
-	}
-	fmt.Println("Created SPDYExecutor")
-
-	stdIn := reader
-	stdOut := new(Writer)
-	stdErr := new(Writer)
-
-	//Execute the command, with Std(in,out,err) pointing to the
-	//above readers and writers
-	fmt.Println("Executing remotecommand")
-	err = exec.Stream(remotecommand.StreamOptions{
-		Stdin: stdIn,
-		//Stdout: stdOut,
-		Stderr: stdErr,
-		Tty:    false,
-	})
-	if err != nil {
-		//fmt.Printf("Stdin: %v\n", stdIn)
-		fmt.Printf("StdOut: %v\n", stdOut)
-		fmt.Printf("StdErr: %v\n", stdErr)
-		panic(fmt.Errorf("Error executing remote command: %v", err))
-	}
 }
 
 func prompt() {
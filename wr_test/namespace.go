@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/namesgenerator"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels and annotations put on every namespace the deployer creates, so that
+// the janitor can tell which namespaces are ours, who made them and when they
+// may be thrown away.
+const (
+	managedByLabel    = "wr-deployer/managed-by"
+	managedByValue    = "wr-deployer"
+	ownerLabel        = "wr-deployer/owner"
+	createdAnnotation = "wr-deployer/created"
+	ttlAnnotation     = "wr-deployer/ttl"
+)
+
+// managedSelector selects every namespace created by the deployer.
+var managedSelector = managedByLabel + "=" + managedByValue
+
+// invalidLabelChars matches anything not allowed in a label value.
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// namespaceName returns a random, DNS safe namespace name ending in -wr.
+func namespaceName() string {
+	return strings.Replace(namesgenerator.GetRandomName(0), "_", "-", -1) + "-wr"
+}
+
+// currentOwner returns the name of the local user, cleaned up so that it can
+// be used as a label value.
+func currentOwner() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	name = strings.Trim(invalidLabelChars.ReplaceAllString(name, "-"), "-_.")
+	if len(name) > 63 {
+		name = strings.Trim(name[:63], "-_.")
+	}
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// wrNamespace returns a namespace carrying the deployer's ownership metadata.
+// A ttl of 0 leaves out the ttl annotation, so the namespace never expires.
+func wrNamespace(name string, owner string, created time.Time, ttl time.Duration) *apiv1.Namespace {
+	ns := &apiv1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+				ownerLabel:     owner,
+			},
+			Annotations: map[string]string{
+				createdAnnotation: created.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	if ttl > 0 {
+		ns.ObjectMeta.Annotations[ttlAnnotation] = ttl.String()
+	}
+	return ns
+}
+
+// namespaceAttempts is how many random names createNamespace tries before
+// giving up.
+const namespaceAttempts = 5
+
+// createNamespace creates a uniquely named namespace for a wr deployment,
+// returning its name. If a name is already taken it tries another.
+func createNamespace(clientset kubernetes.Interface, ttl time.Duration) (string, error) {
+	namespaceClient := clientset.CoreV1().Namespaces()
+	owner := currentOwner()
+	for attempt := 1; ; attempt++ {
+		newNamespace := namespaceName()
+		_, err := namespaceClient.Create(wrNamespace(newNamespace, owner, time.Now(), ttl))
+		switch {
+		case err == nil:
+			return newNamespace, nil
+		case !apierrors.IsAlreadyExists(err):
+			return "", fmt.Errorf("failed to create namespace %s: %v", newNamespace, err)
+		case attempt == namespaceAttempts:
+			return "", fmt.Errorf("no unused namespace name found after %d attempts, the last was %s", attempt, newNamespace)
+		}
+		fmt.Printf("Namespace %s already exists, trying another name\n", newNamespace)
+	}
+}
+
+// namespaceExpiry returns the time after which the given namespace may be
+// deleted. ok is false if the namespace has no (valid) ttl.
+func namespaceExpiry(ns *apiv1.Namespace) (expiry time.Time, ok bool) {
+	ttl, err := time.ParseDuration(ns.ObjectMeta.Annotations[ttlAnnotation])
+	if err != nil || ttl <= 0 {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339, ns.ObjectMeta.Annotations[createdAnnotation])
+	if err != nil {
+		created = ns.ObjectMeta.CreationTimestamp.Time
+	}
+	return created.Add(ttl), true
+}
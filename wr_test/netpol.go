@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Names of the NetworkPolicies guarding the manager's ports.
+const (
+	managerPolicyName = "wr-manager-port"
+	webPolicyName     = "wr-web-port"
+)
+
+// Who may reach the manager's web interface.
+const (
+	webAccessNone      = "none"
+	webAccessNamespace = "namespace"
+	webAccessCIDR      = "cidr"
+	webAccessAll       = "all"
+)
+
+// runnerLabels are the labels carried by wr runner pods, which are the only
+// pods allowed to talk to the manager port.
+var runnerLabels = map[string]string{"app": "wr-runner"}
+
+// managerLabels are the labels carried by the wr manager pod.
+var managerLabels = map[string]string{"app": "wr-manager"}
+
+// netpolOpts configures the NetworkPolicies put on a wr namespace.
+//
+// Port forwards through the API server (kubectl port-forward, or our own
+// copying and exec) connect to the pod from inside its own network namespace,
+// so they are not subject to the policies. ManagerCIDRs is there for anything
+// that does go over the pod network, such as the API server's service proxy.
+type netpolOpts struct {
+	Enabled      bool
+	ManagerCIDRs []string
+	WebAccess    string
+	WebCIDRs     []string
+}
+
+// addFlags registers the network policy options on the given command.
+func (n *netpolOpts) addFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&n.Enabled, "network-policy", false, "Only let wr runner pods in the namespace reach the manager port")
+	c.Flags().StringSliceVar(&n.ManagerCIDRs, "manager-allow-cidr", nil, "Additional CIDRs (eg. of the API server) allowed to reach the manager port")
+	c.Flags().StringVar(&n.WebAccess, "web-access", webAccessNamespace, "Who may reach the web interface: none, namespace, cidr or all")
+	c.Flags().StringSliceVar(&n.WebCIDRs, "web-allow-cidr", nil, "CIDRs allowed to reach the web interface when --web-access=cidr")
+}
+
+// networkPolicies builds the policies described by the options: one letting
+// runners reach the manager port, and one for the web port unless web access
+// is turned off. Either way, once a policy selects the manager pod all other
+// ingress to it is denied.
+func (n *netpolOpts) networkPolicies() ([]*networkingv1.NetworkPolicy, error) {
+	managerPeers := []networkingv1.NetworkPolicyPeer{
+		{
+			PodSelector: &metav1.LabelSelector{MatchLabels: runnerLabels},
+		},
+	}
+	cidrPeers, err := ipBlockPeers("--manager-allow-cidr", n.ManagerCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	managerPeers = append(managerPeers, cidrPeers...)
+	policies := []*networkingv1.NetworkPolicy{
+		managerIngressPolicy(managerPolicyName, managerPort, managerPeers),
+	}
+
+	switch n.WebAccess {
+	case webAccessNone:
+	case webAccessNamespace:
+		//An empty pod selector matches every pod in the namespace
+		policies = append(policies, managerIngressPolicy(webPolicyName, webPort, []networkingv1.NetworkPolicyPeer{
+			{
+				PodSelector: &metav1.LabelSelector{},
+			},
+		}))
+	case webAccessCIDR:
+		if len(n.WebCIDRs) == 0 {
+			return nil, fmt.Errorf("--web-access=cidr needs at least one --web-allow-cidr")
+		}
+		webPeers, err := ipBlockPeers("--web-allow-cidr", n.WebCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, managerIngressPolicy(webPolicyName, webPort, webPeers))
+	case webAccessAll:
+		//A rule with no peers allows traffic from anywhere
+		policies = append(policies, managerIngressPolicy(webPolicyName, webPort, nil))
+	default:
+		return nil, fmt.Errorf("unknown web access %q, must be one of none, namespace, cidr or all", n.WebAccess)
+	}
+	return policies, nil
+}
+
+// managerIngressPolicy returns a policy allowing the given peers to reach the
+// given port of the manager pod.
+func managerIngressPolicy(name string, port int32, peers []networkingv1.NetworkPolicyPeer) *networkingv1.NetworkPolicy {
+	protocol := apiv1.ProtocolTCP
+	target := intstr.FromInt(int(port))
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: managerLabels},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{
+							Protocol: &protocol,
+							Port:     &target,
+						},
+					},
+					From: peers,
+				},
+			},
+		},
+	}
+}
+
+// ipBlockPeers turns a list of CIDRs in to policy peers, checking they're
+// valid so a bad one is caught before anything is created. flag names the
+// option they came from.
+func ipBlockPeers(flag string, cidrs []string) ([]networkingv1.NetworkPolicyPeer, error) {
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("bad %s %q: %v", flag, cidr, err)
+		}
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+	return peers, nil
+}
+
+// createNetworkPolicies creates the policies in the given namespace.
+func createNetworkPolicies(clientset kubernetes.Interface, namespace string, n *netpolOpts) error {
+	policies, err := n.networkPolicies()
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		if _, err := clientset.NetworkingV1().NetworkPolicies(namespace).Create(policy); err != nil {
+			return fmt.Errorf("failed to create NetworkPolicy %s: %v", policy.ObjectMeta.Name, err)
+		}
+	}
+	return nil
+}
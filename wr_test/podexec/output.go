@@ -0,0 +1,94 @@
+package podexec
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Output captures the last bytes written to it in a fixed size ring buffer,
+// so a chatty command can't use up memory.
+type Output struct {
+	mu    sync.Mutex
+	data  []byte
+	pos   int
+	total int64
+}
+
+// NewOutput returns an Output keeping the last limit bytes written to it. A
+// limit of 0 or less keeps nothing, only counting the bytes.
+func NewOutput(limit int) *Output {
+	if limit < 0 {
+		limit = 0
+	}
+	return &Output{data: make([]byte, limit)}
+}
+
+// Write keeps the end of p, overwriting the oldest bytes once full. It never
+// fails.
+func (o *Output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := len(p)
+	o.total += int64(n)
+	if len(o.data) == 0 {
+		return n, nil
+	}
+	if len(p) > len(o.data) {
+		p = p[len(p)-len(o.data):]
+	}
+	copied := copy(o.data[o.pos:], p)
+	copy(o.data, p[copied:])
+	o.pos = (o.pos + len(p)) % len(o.data)
+	return n, nil
+}
+
+// Bytes returns a copy of the kept output, oldest first.
+func (o *Output) Bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.total <= int64(len(o.data)) {
+		return append([]byte(nil), o.data[:o.total]...)
+	}
+	return append(append([]byte(nil), o.data[o.pos:]...), o.data[:o.pos]...)
+}
+
+// String returns the kept output.
+func (o *Output) String() string {
+	return string(o.Bytes())
+}
+
+// Total is the number of bytes ever written, kept or not.
+func (o *Output) Total() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.total
+}
+
+// Truncated reports whether some output has been dropped.
+func (o *Output) Truncated() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.total > int64(len(o.data))
+}
+
+// Lines splits the kept output in to lines, without their line endings. If
+// output was dropped the first, partial, line is left out.
+func (o *Output) Lines() []string {
+	kept := o.Bytes()
+	if o.Truncated() {
+		if i := bytes.IndexByte(kept, '\n'); i >= 0 {
+			kept = kept[i+1:]
+		} else {
+			kept = nil
+		}
+	}
+	kept = bytes.TrimSuffix(kept, []byte("\n"))
+	if len(kept) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, line := range bytes.Split(kept, []byte("\n")) {
+		lines = append(lines, string(bytes.TrimSuffix(line, []byte("\r"))))
+	}
+	return lines
+}
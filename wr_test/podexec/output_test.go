@@ -0,0 +1,48 @@
+package podexec
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestOutput(t *testing.T) {
+	o := NewOutput(15)
+	o.Write([]byte("one\ntwo\n"))
+	assert.False(t, o.Truncated())
+	assert.Equal(t, []string{"one", "two"}, o.Lines())
+
+	//Writing past the limit keeps the end, dropping the partial first line
+	o.Write([]byte("three\nfour\r\nfive"))
+	assert.True(t, o.Truncated())
+	assert.Equal(t, int64(24), o.Total())
+	assert.Equal(t, "hree\nfour\r\nfive", o.String())
+	assert.Equal(t, []string{"four", "five"}, o.Lines())
+
+	//A single write bigger than the buffer
+	o = NewOutput(4)
+	o.Write([]byte("abcdefgh"))
+	assert.Equal(t, "efgh", o.String())
+	assert.Nil(t, o.Lines())
+
+	//No limit keeps nothing, but still counts
+	for _, limit := range []int{0, -1} {
+		o = NewOutput(limit)
+		n, err := o.Write([]byte("abc"))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Empty(t, o.String())
+		assert.True(t, o.Truncated())
+		assert.Equal(t, int64(3), o.Total())
+		assert.Nil(t, o.Lines())
+	}
+}
+
+func TestIsCommandFailure(t *testing.T) {
+	assert.True(t, IsCommandFailure(utilexec.CodeExitError{Err: fmt.Errorf("exit 3"), Code: 3}))
+	assert.False(t, IsCommandFailure(&StreamError{Err: fmt.Errorf("connection reset")}))
+	assert.False(t, IsCommandFailure(&TimeoutError{}))
+	assert.False(t, IsCommandFailure(nil))
+}
@@ -0,0 +1,162 @@
+// Package podexec runs commands in the containers of Kubernetes pods, like
+// 'kubectl exec', capturing their output and exit code.
+package podexec
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// DefaultMaxOutput is how much of each of stdout and stderr is kept when
+// Options.MaxOutput isn't set.
+const DefaultMaxOutput = 64 * 1024
+
+// Options says what to run and where.
+type Options struct {
+	Namespace string
+	Pod       string
+	// Container may be left empty for pods with a single container.
+	Container string
+	// Command is the argv of the command; it isn't run through a shell.
+	Command []string
+	// Stdin, if not nil, is copied to the command's input.
+	Stdin io.Reader
+	// Stdout and Stderr, if not nil, are sent the command's output as it
+	// arrives, as well as it being captured in the Result.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Timeout is how long the command may take; 0 means no limit.
+	Timeout time.Duration
+	// MaxOutput is the number of bytes of each of stdout and stderr kept in
+	// the Result; anything before the last MaxOutput bytes is dropped.
+	MaxOutput int
+	// Transport is how to talk to the API server: TransportAuto (the
+	// default), TransportSPDY or TransportWebSocket.
+	Transport string
+}
+
+// Result is what a command did.
+type Result struct {
+	Stdout *Output
+	Stderr *Output
+	// ExitCode is the command's exit status, or -1 if it didn't exit (the
+	// stream failed or timed out).
+	ExitCode int
+	Took     time.Duration
+}
+
+// StreamError is returned when the command couldn't be run or its stream to
+// the API server failed, so it's not known how the command got on.
+type StreamError struct {
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("exec stream failed: %v", e.Err)
+}
+
+// TimeoutError is returned when the command runs for longer than
+// Options.Timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.Timeout)
+}
+
+// IsCommandFailure reports whether err is the command exiting with a
+// non-zero status, as opposed to it not being run to completion.
+func IsCommandFailure(err error) bool {
+	exitErr, ok := err.(utilexec.ExitError)
+	return ok && exitErr.Exited()
+}
+
+// Run runs a command in a container of a pod and waits for it to finish. The
+// Result is always returned, with whatever output was captured. The error is
+// nil if the command exited 0, a util/exec.ExitError if it exited with
+// another status, a *TimeoutError if it ran out of time and a *StreamError if
+// it couldn't be run or the connection failed.
+//
+// On a timeout the stream is abandoned rather than closed, as the executor
+// can't be interrupted; the command may carry on running in the container.
+func Run(config *rest.Config, clientset kubernetes.Interface, opts Options) (*Result, error) {
+	maxOutput := opts.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	result := &Result{
+		Stdout:   NewOutput(maxOutput),
+		Stderr:   NewOutput(maxOutput),
+		ExitCode: -1,
+	}
+	stdout := io.Writer(result.Stdout)
+	if opts.Stdout != nil {
+		stdout = io.MultiWriter(result.Stdout, opts.Stdout)
+	}
+	stderr := io.Writer(result.Stderr)
+	if opts.Stderr != nil {
+		stderr = io.MultiWriter(result.Stderr, opts.Stderr)
+	}
+
+	execRequest := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(opts.Pod).
+		Namespace(opts.Namespace).
+		SubResource("exec")
+	execRequest.VersionedParams(&apiv1.PodExecOptions{
+		Container: opts.Container,
+		Command:   opts.Command,
+		Stdin:     opts.Stdin != nil,
+		Stdout:    true,
+		Stderr:    true,
+		TTY:       false,
+	}, scheme.ParameterCodec)
+	exec, err := NewExecutor(config, execRequest.URL(), opts.Transport)
+	if err != nil {
+		return result, &StreamError{Err: err}
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- exec.Stream(remotecommand.StreamOptions{
+			Stdin:  opts.Stdin,
+			Stdout: stdout,
+			Stderr: stderr,
+			Tty:    false,
+		})
+	}()
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err = <-done:
+	case <-timeout:
+		result.Took = time.Since(start)
+		return result, &TimeoutError{Timeout: opts.Timeout}
+	}
+	result.Took = time.Since(start)
+
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+		return result, nil
+	case IsCommandFailure(err):
+		result.ExitCode = err.(utilexec.ExitError).ExitStatus()
+		return result, err
+	default:
+		return result, &StreamError{Err: err}
+	}
+}
@@ -0,0 +1,101 @@
+package podexec
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestWebSocketExecutor(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			auth = req.Header.Get("Authorization")
+			config.Protocol = []string{channelProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			//Open the channels, echo the first input to stdout, complain on
+			//stderr and exit 3
+			for _, channel := range []byte{stdinChannel, stdoutChannel, stderrChannel, errorChannel} {
+				websocket.Message.Send(ws, []byte{channel})
+			}
+			var input []byte
+			websocket.Message.Receive(ws, &input)
+			websocket.Message.Send(ws, append([]byte{stdoutChannel}, input[1:]...))
+			websocket.Message.Send(ws, append([]byte{stderrChannel}, "oops"...))
+			websocket.Message.Send(ws, append([]byte{errorChannel}, `{"status":"Failure","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"3"}]}}`...))
+		},
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/api/v1/namespaces/wr/pods/wr-manager/exec?command=cat&stdin=true")
+	assert.NoError(t, err)
+	exec, err := NewExecutor(&rest.Config{Host: server.URL, BearerToken: "secret"}, u, TransportWebSocket)
+	assert.NoError(t, err)
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdin:  strings.NewReader("hello"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	assert.True(t, IsCommandFailure(err))
+	assert.Equal(t, 3, err.(utilexec.ExitError).ExitStatus())
+	assert.Equal(t, "hello", stdout.String())
+	assert.Equal(t, "oops", stderr.String())
+	assert.Equal(t, "Bearer secret", auth)
+
+	assert.NoError(t, decodeStatus([]byte(`{"status":"Success"}`)))
+}
+
+func TestFallbackExecutor(t *testing.T) {
+	//The server refuses SPDY, as the API server does when a proxy strips the
+	//upgrade headers, but speaks WebSocket
+	refusal := http.StatusBadRequest
+	ws := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			config.Protocol = []string{channelProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			websocket.Message.Send(ws, append([]byte{stdoutChannel}, "over websocket"...))
+			websocket.Message.Send(ws, append([]byte{errorChannel}, `{"status":"Success"}`...))
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, req)
+			return
+		}
+		http.Error(w, "Upgrade request required", refusal)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/api/v1/namespaces/wr/pods/wr-manager/exec?command=ls&stdout=true")
+	assert.NoError(t, err)
+	exec, err := NewExecutor(&rest.Config{Host: server.URL}, u, TransportAuto)
+	assert.NoError(t, err)
+	var stdout bytes.Buffer
+	assert.NoError(t, exec.Stream(remotecommand.StreamOptions{Stdout: &stdout}))
+	assert.Equal(t, "over websocket", stdout.String())
+
+	//A refused request isn't retried
+	refusal = http.StatusForbidden
+	stdout.Reset()
+	err = exec.Stream(remotecommand.StreamOptions{Stdout: &stdout})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, err.(*upgradeError).StatusCode)
+	assert.Empty(t, stdout.String())
+	assert.False(t, isUpgradeFailure(err))
+	assert.False(t, isUpgradeFailure(fmt.Errorf("unable to upgrade connection: 400 Bad Request")))
+}
@@ -0,0 +1,399 @@
+package podexec
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// Transports an executor can use to talk to the API server.
+const (
+	// TransportAuto uses SPDY, falling back to WebSocket if the connection
+	// can't be upgraded to SPDY, as happens through some proxies.
+	TransportAuto      = "auto"
+	TransportSPDY      = "spdy"
+	TransportWebSocket = "websocket"
+)
+
+// channelProtocol is the WebSocket subprotocol used for exec and attach.
+const channelProtocol = "v4.channel.k8s.io"
+
+// Channels of the channel protocol; each message starts with one of these.
+const (
+	stdinChannel byte = iota
+	stdoutChannel
+	stderrChannel
+	errorChannel
+	resizeChannel
+)
+
+// NewExecutor returns an executor for the exec or attach request at url,
+// using the given transport.
+func NewExecutor(config *rest.Config, url *url.URL, transport string) (remotecommand.Executor, error) {
+	switch transport {
+	case TransportSPDY:
+		return remotecommand.NewSPDYExecutor(config, "POST", url)
+	case TransportWebSocket:
+		return NewWebSocketExecutor(config, url)
+	case TransportAuto, "":
+		transport, upgrader, err := spdy.RoundTripperFor(config)
+		if err != nil {
+			return nil, err
+		}
+		exec, err := remotecommand.NewSPDYExecutorForTransports(transport, statusUpgrader{upgrader}, "POST", url)
+		if err != nil {
+			return nil, err
+		}
+		return &fallbackExecutor{spdy: exec, config: config, url: url}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q, must be auto, spdy or websocket", transport)
+	}
+}
+
+// fallbackExecutor tries SPDY, then WebSocket if the upgrade to SPDY fails.
+type fallbackExecutor struct {
+	spdy   remotecommand.Executor
+	config *rest.Config
+	url    *url.URL
+}
+
+func (e *fallbackExecutor) Stream(options remotecommand.StreamOptions) error {
+	err := e.spdy.Stream(options)
+	if !isUpgradeFailure(err) {
+		return err
+	}
+	//Nothing has been read from stdin if the connection was never upgraded,
+	//so the command can be started again from scratch.
+	ws, wsErr := NewWebSocketExecutor(e.config, e.url)
+	if wsErr != nil {
+		return err
+	}
+	return ws.Stream(options)
+}
+
+// upgradeError is a failure to upgrade the connection to SPDY, with the HTTP
+// status the server answered with instead of 101 Switching Protocols.
+type upgradeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *upgradeError) Error() string {
+	return e.Err.Error()
+}
+
+// statusUpgrader wraps an Upgrader so that a failed upgrade returns an
+// upgradeError.
+type statusUpgrader struct {
+	spdy.Upgrader
+}
+
+func (u statusUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.Upgrader.NewConnection(resp)
+	if err != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &upgradeError{StatusCode: resp.StatusCode, Err: err}
+	}
+	return conn, err
+}
+
+// isUpgradeFailure reports whether err is the connection not being upgraded
+// to SPDY, as happens when a proxy strips the upgrade headers. The request
+// being refused or the pod not being found would fail the same way over
+// WebSocket, so those aren't.
+func isUpgradeFailure(err error) bool {
+	upgradeErr, ok := err.(*upgradeError)
+	if !ok {
+		return false
+	}
+	switch upgradeErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false
+	}
+	return true
+}
+
+// websocketExecutor streams over the WebSocket channel protocol.
+//
+// Unlike SPDY, v4.channel.k8s.io has no way to close the command's stdin, so
+// a command reading stdin must know for itself when its input ends.
+type websocketExecutor struct {
+	config *rest.Config
+	url    *url.URL
+}
+
+// NewWebSocketExecutor returns an executor for the exec or attach request at
+// url that speaks the WebSocket channel protocol instead of SPDY.
+func NewWebSocketExecutor(config *rest.Config, url *url.URL) (remotecommand.Executor, error) {
+	switch url.Scheme {
+	case "https", "http":
+	default:
+		return nil, fmt.Errorf("can't use WebSocket for %s", url)
+	}
+	return &websocketExecutor{config: config, url: url}, nil
+}
+
+func (e *websocketExecutor) Stream(options remotecommand.StreamOptions) error {
+	ws, err := e.connect()
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var writeLock sync.Mutex
+	send := func(channel byte, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return websocket.Message.Send(ws, append([]byte{channel}, data...))
+	}
+	if options.Stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := options.Stdin.Read(buf)
+				if n > 0 && send(stdinChannel, buf[:n]) != nil {
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	if options.TerminalSizeQueue != nil {
+		go func() {
+			for size := options.TerminalSizeQueue.Next(); size != nil; size = options.TerminalSizeQueue.Next() {
+				data, err := json.Marshal(size)
+				if err != nil || send(resizeChannel, data) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var status []byte
+	for {
+		var message []byte
+		if err := websocket.Message.Receive(ws, &message); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(message) < 2 {
+			//Each channel is opened with an empty message.
+			continue
+		}
+		var out io.Writer
+		switch message[0] {
+		case stdoutChannel:
+			out = options.Stdout
+		case stderrChannel:
+			out = options.Stderr
+		case errorChannel:
+			status = append(status, message[1:]...)
+		}
+		if out != nil {
+			if _, err := out.Write(message[1:]); err != nil {
+				return err
+			}
+		}
+	}
+	return decodeStatus(status)
+}
+
+// decodeStatus turns the Status sent on the error channel in to an error,
+// with a non-zero exit code as a util/exec.ExitError like the SPDY executor.
+func decodeStatus(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("error stream protocol error: %v in %q", err, string(data))
+	}
+	if status.Status == metav1.StatusSuccess {
+		return nil
+	}
+	if status.Reason == "NonZeroExitCode" && status.Details != nil {
+		for _, cause := range status.Details.Causes {
+			if cause.Type == "ExitCode" {
+				code, err := strconv.Atoi(cause.Message)
+				if err != nil {
+					return fmt.Errorf("error stream protocol error: invalid exit code %q", cause.Message)
+				}
+				return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+			}
+		}
+	}
+	return fmt.Errorf("error executing remote command: %s", status.Message)
+}
+
+// connect dials the API server, through any proxy set in the environment,
+// and opens the WebSocket with the credentials from the rest config.
+func (e *websocketExecutor) connect() (*websocket.Conn, error) {
+	location := *e.url
+	origin := *e.url
+	origin.Path, origin.RawQuery = "", ""
+	if location.Scheme == "https" {
+		location.Scheme = "wss"
+	} else {
+		location.Scheme = "ws"
+	}
+	wsConfig, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	wsConfig.Protocol = []string{channelProtocol}
+	if wsConfig.Header, err = authHeaders(e.config, e.url); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialAPIServer(e.config, e.url)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s failed: %v", e.url.Host, err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// headerCapture is a RoundTripper that records the headers of the request
+// instead of sending it.
+type headerCapture struct {
+	header http.Header
+}
+
+func (h *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.header = req.Header
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+// authHeaders works out the headers the rest config would authenticate a
+// request to u with: bearer tokens, basic auth, auth plugins and so on.
+func authHeaders(config *rest.Config, u *url.URL) (http.Header, error) {
+	capture := &headerCapture{}
+	rt, err := rest.HTTPWrappersForConfig(config, capture)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	header := http.Header{}
+	for name, values := range capture.header {
+		header[name] = values
+	}
+	return header, nil
+}
+
+// dialAPIServer opens a connection to the API server for u, going through an
+// HTTP CONNECT proxy if the environment says to, and starting TLS for https.
+func dialAPIServer(config *rest.Config, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxy == nil {
+		conn, err = net.Dial("tcp", host)
+	} else {
+		conn, err = dialThroughProxy(proxy, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialThroughProxy opens a tunnel to host through an HTTP proxy.
+func dialThroughProxy(proxy *url.URL, host string) (net.Conn, error) {
+	proxyHost := proxy.Host
+	if proxy.Port() == "" {
+		proxyHost = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := net.Dial("tcp", proxyHost)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Host, host, resp.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// probeOpts configures the health checks of the manager container, and the
+// deeper check the deployer does before calling a deployment usable.
+type probeOpts struct {
+	Disabled         bool
+	InitialDelay     int32
+	Period           int32
+	FailureThreshold int32
+	// UsableTimeout is how long deploy waits for the manager to pass the
+	// deep check. 0 skips the check.
+	UsableTimeout time.Duration
+}
+
+// addFlags registers the probe options on the given command.
+func (p *probeOpts) addFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&p.Disabled, "no-probes", false, "Don't give the manager container readiness and liveness probes")
+	c.Flags().Int32Var(&p.InitialDelay, "probe-delay", 10, "Seconds after the manager starts before it is first probed")
+	c.Flags().Int32Var(&p.Period, "probe-period", 10, "Seconds between probes of the manager")
+	c.Flags().Int32Var(&p.FailureThreshold, "probe-failures", 3, "Failed liveness probes before the manager is restarted")
+	c.Flags().DurationVar(&p.UsableTimeout, "usable-timeout", 5*time.Minute, "How long to wait for the manager to answer 'wr status' (0 to not wait)")
+}
+
+// addProbes gives the manager container a TCP readiness probe on the manager
+// port and an HTTP liveness probe on the web port. The liveness probe uses
+// https if the web interface is served with TLS.
+func (p *probeOpts) addProbes(container *apiv1.Container, tls bool) {
+	if p.Disabled {
+		return
+	}
+	scheme := apiv1.URISchemeHTTP
+	if tls {
+		scheme = apiv1.URISchemeHTTPS
+	}
+	container.ReadinessProbe = &apiv1.Probe{
+		Handler: apiv1.Handler{
+			TCPSocket: &apiv1.TCPSocketAction{
+				Port: intstr.FromString("wr-manager"),
+			},
+		},
+		InitialDelaySeconds: p.InitialDelay,
+		PeriodSeconds:       p.Period,
+	}
+	container.LivenessProbe = &apiv1.Probe{
+		Handler: apiv1.Handler{
+			HTTPGet: &apiv1.HTTPGetAction{
+				Path:   "/",
+				Port:   intstr.FromString("wr-web"),
+				Scheme: scheme,
+			},
+		},
+		InitialDelaySeconds: p.InitialDelay,
+		PeriodSeconds:       p.Period,
+		FailureThreshold:    p.FailureThreshold,
+	}
+}
+
+// podReady reports whether the pod's Ready condition is true.
+func podReady(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// waitUsable waits for the manager pod to be Ready and for 'wr status' run
+// inside it to succeed, which means the manager has bound its port and opened
+// its database.
+func waitUsable(config *rest.Config, clientset kubernetes.Interface, namespace string, podName string, timeout time.Duration) error {
+	var lastErr error
+	err := wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase == apiv1.PodFailed || pod.Status.Phase == apiv1.PodSucceeded {
+			return false, fmt.Errorf("manager pod %s has stopped (%s)", podName, pod.Status.Phase)
+		}
+		if !podReady(pod) {
+			lastErr = fmt.Errorf("manager pod %s is not ready", podName)
+			return false, nil
+		}
+		lastErr = deepCheck(config, clientset, pod)
+		return lastErr == nil, nil
+	})
+	if err == wait.ErrWaitTimeout && lastErr != nil {
+		return fmt.Errorf("manager not usable after %s: %v", timeout, lastErr)
+	}
+	return err
+}
+
+// deepCheck runs 'wr status' in the manager container.
+func deepCheck(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod) error {
+	_, err := managerStatus(config, clientset, pod)
+	return err
+}
+
+// managerStatus returns the output of 'wr status' run in the manager
+// container.
+func managerStatus(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := execInContainer(config, clientset, pod, "wr-manager", []string{"/wr-tmp/wr", "status"}, &stdout, &stderr)
+	if err != nil {
+		return "", fmt.Errorf("wr status failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Names of the ResourceQuota and LimitRange the deployer creates.
+const (
+	quotaName      = "wr-quota"
+	limitRangeName = "wr-limits"
+)
+
+// quotaOpts configures the ResourceQuota and LimitRange put on a wr
+// namespace. Empty values are left out of the quota.
+type quotaOpts struct {
+	Enabled bool
+	Pods    int
+	CPU     string
+	Memory  string
+	Storage string
+	// DefaultCPU is the cpu request and limit given to containers that don't
+	// ask for any. Memory and disk defaults come from cloudram and clouddisk.
+	DefaultCPU string
+}
+
+// addFlags registers the quota options on the given command.
+func (q *quotaOpts) addFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&q.Enabled, "quota", false, "Create a ResourceQuota and LimitRange in the new namespace")
+	c.Flags().IntVar(&q.Pods, "quota-pods", 50, "Maximum number of pods in the namespace (0 for no limit)")
+	c.Flags().StringVar(&q.CPU, "quota-cpu", "20", "Total cpu that may be requested in the namespace")
+	c.Flags().StringVar(&q.Memory, "quota-memory", "64Gi", "Total memory that may be requested in the namespace")
+	c.Flags().StringVar(&q.Storage, "quota-storage", "100Gi", "Total storage that may be requested by PersistentVolumeClaims in the namespace")
+	c.Flags().StringVar(&q.DefaultCPU, "default-cpu", "1", "Cpu given to containers that don't specify any")
+}
+
+// resourceQuota builds the ResourceQuota described by the options.
+func (q *quotaOpts) resourceQuota() (*apiv1.ResourceQuota, error) {
+	hard := apiv1.ResourceList{}
+	if q.Pods > 0 {
+		hard[apiv1.ResourcePods] = *resource.NewQuantity(int64(q.Pods), resource.DecimalSI)
+	}
+	for _, r := range []struct {
+		value string
+		names []apiv1.ResourceName
+	}{
+		{q.CPU, []apiv1.ResourceName{apiv1.ResourceRequestsCPU, apiv1.ResourceLimitsCPU}},
+		{q.Memory, []apiv1.ResourceName{apiv1.ResourceRequestsMemory, apiv1.ResourceLimitsMemory}},
+		{q.Storage, []apiv1.ResourceName{apiv1.ResourceRequestsStorage}},
+	} {
+		if r.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(r.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota %q: %v", r.value, err)
+		}
+		for _, name := range r.names {
+			hard[name] = quantity
+		}
+	}
+	return &apiv1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: quotaName,
+		},
+		Spec: apiv1.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}, nil
+}
+
+// limitRange builds a LimitRange giving containers defaults matching the
+// servers wr would pick in the cloud: cloudram MB of memory and clouddisk GB
+// of disk.
+func (q *quotaOpts) limitRange(config *wrConfig) (*apiv1.LimitRange, error) {
+	cpu, err := resource.ParseQuantity(q.DefaultCPU)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default cpu %q: %v", q.DefaultCPU, err)
+	}
+	defaults := apiv1.ResourceList{
+		apiv1.ResourceCPU:    cpu,
+		apiv1.ResourceMemory: *resource.NewQuantity(int64(config.CloudRAM)*1024*1024, resource.BinarySI),
+	}
+	if config.CloudDisk > 0 {
+		defaults[apiv1.ResourceEphemeralStorage] = *resource.NewQuantity(int64(config.CloudDisk)*1024*1024*1024, resource.BinarySI)
+	}
+	return &apiv1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: limitRangeName,
+		},
+		Spec: apiv1.LimitRangeSpec{
+			Limits: []apiv1.LimitRangeItem{
+				{
+					Type:           apiv1.LimitTypeContainer,
+					Default:        defaults,
+					DefaultRequest: defaults,
+				},
+			},
+		},
+	}, nil
+}
+
+// createQuota creates the ResourceQuota and LimitRange in the given namespace.
+func createQuota(clientset kubernetes.Interface, namespace string, q *quotaOpts, config *wrConfig) error {
+	quota, err := q.resourceQuota()
+	if err != nil {
+		return err
+	}
+	limits, err := q.limitRange(config)
+	if err != nil {
+		return err
+	}
+	//The LimitRange goes first, so nothing is rejected by the quota for
+	//lacking requests.
+	if _, err := clientset.CoreV1().LimitRanges(namespace).Create(limits); err != nil {
+		return fmt.Errorf("failed to create LimitRange: %v", err)
+	}
+	if _, err := clientset.CoreV1().ResourceQuotas(namespace).Create(quota); err != nil {
+		return fmt.Errorf("failed to create ResourceQuota: %v", err)
+	}
+	return nil
+}
+
+// printQuotaUsage writes a table of the usage of every quota in the given
+// namespace.
+func printQuotaUsage(clientset kubernetes.Interface, namespace string, out io.Writer) error {
+	quotas, err := clientset.CoreV1().ResourceQuotas(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list quotas in namespace %s: %v", namespace, err)
+	}
+	if len(quotas.Items) == 0 {
+		fmt.Fprintln(out, "No quota.")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUOTA\tRESOURCE\tUSED\tHARD")
+	for _, quota := range quotas.Items {
+		names := make([]string, 0, len(quota.Status.Hard))
+		for name := range quota.Status.Hard {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			hard := quota.Status.Hard[apiv1.ResourceName(name)]
+			used := quota.Status.Used[apiv1.ResourceName(name)]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", quota.ObjectMeta.Name, name, used.String(), hard.String())
+		}
+	}
+	return w.Flush()
+}
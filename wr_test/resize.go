@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchResizes calls resized every time the controlling terminal changes size,
+// until done is closed.
+func watchResizes(resized func(), done <-chan struct{}) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	for {
+		select {
+		case <-winch:
+			resized()
+		case <-done:
+			return
+		}
+	}
+}
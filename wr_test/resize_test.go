@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchResizes(t *testing.T) {
+	resized := make(chan struct{}, 1)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchResizes(func() {
+			select {
+			case resized <- struct{}{}:
+			default:
+			}
+		}, done)
+		close(stopped)
+	}()
+
+	//The watcher may not be listening for the first few signals yet
+	deadline := time.After(5 * time.Second)
+	for got := false; !got; {
+		syscall.Kill(syscall.Getpid(), syscall.SIGWINCH)
+		select {
+		case <-resized:
+			got = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no resize after SIGWINCH")
+		}
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchResizes didn't return once done")
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// watchResizes does nothing on Windows, which has no SIGWINCH; the remote
+// terminal keeps the size it started with.
+func watchResizes(resized func(), done <-chan struct{}) {
+	<-done
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// checkRestoreFile makes sure a database backup to restore from exists and,
+// if it has a checksum file as written by the backup command, that it is
+// intact.
+func checkRestoreFile(name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Size() == 0 {
+		return fmt.Errorf("%s is not a database backup", name)
+	}
+	if _, err := os.Stat(name + checksumSuffix); os.IsNotExist(err) {
+		fmt.Printf("Warning: %s has no checksum file, so can't be verified\n", name)
+		return nil
+	}
+	return verifyBackup(name)
+}
+
+// restoreFileName is the name the database backup is sent under, whatever it
+// was called locally, so it can't clash with the wr binary.
+const restoreFileName = "restore.db"
+
+// restoreDb changes the manager container to put the shipped database backup
+// at managerdbfile before starting the manager. The backup is copied by the
+// init container in to tmpDir, as restoreFileName, along with the wr binary.
+//
+// The database is only put in place if there isn't one already, so that this
+// is harmless should the manager process be restarted within its container.
+func restoreDb(container *apiv1.Container, tmpDir string, dbFile string) {
+	shipped := path.Join(tmpDir, restoreFileName)
+	start := append(append([]string{}, container.Command...), container.Args...)
+	quoted := make([]string, len(start))
+	for i, arg := range start {
+		quoted[i] = shellQuote(arg)
+	}
+	script := fmt.Sprintf("mkdir -p %s && { [ -e %s ] || cp %s %s; } && exec %s",
+		shellQuote(path.Dir(dbFile)), shellQuote(dbFile), shellQuote(shipped), shellQuote(dbFile), strings.Join(quoted, " "))
+	container.Command = []string{"/bin/sh", "-c"}
+	container.Args = []string{script}
+}
+
+// shellQuote quotes s for use as a single word in a sh command line.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// countJobs adds up the job counts in the output of 'wr status', which has a
+// line of the form "state: count" for each job state.
+func countJobs(status string) int {
+	total := 0
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+			total += n
+		}
+	}
+	return total
+}
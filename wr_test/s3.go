@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Client talks to an S3-compatible object store, such as minio, with path
+// style URLs and AWS Signature Version 4.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Client returns a client for the store at endpoint, with the
+// credentials and region from the environment variables the AWS tools use.
+func newS3Client(endpoint string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad S3 endpoint %q: %v", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad S3 endpoint %q: must be an http or https URL", endpoint)
+	}
+	c := &s3Client{
+		endpoint:  u,
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    http.DefaultClient,
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use S3")
+	}
+	return c, nil
+}
+
+// emptySHA256 is the hash of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do sends a signed request for the key in bucket (or the bucket itself if
+// key is ""). body, if not nil, must have the hex sha256 payloadHash.
+func (c *s3Client) do(method string, bucket string, key string, query url.Values, header http.Header, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	} else {
+		payloadHash = emptySHA256
+	}
+	c.sign(req, payloadHash, time.Now())
+	return c.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to the request,
+// signing its host and every header it has.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape URI-encodes s the way Signature Version 4 expects: everything but
+// unreserved characters, and '/' too if slash is true.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery is the query string, sorted and encoded for signing.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Error turns an unexpected response in to an error, with the message the
+// server gave.
+func s3Error(resp *http.Response, what string) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("%s failed: %s: %s %s", what, resp.Status, body.Code, body.Message)
+	}
+	return fmt.Errorf("%s failed: %s", what, resp.Status)
+}
+
+// errS3Exists is returned by putNew when the key is already taken.
+var errS3Exists = fmt.Errorf("object already exists")
+
+// putNew uploads the file to key in bucket, failing with errS3Exists rather
+// than replacing an object already there.
+func (c *s3Client) putNew(bucket string, key string, file *os.File, payloadHash string) error {
+	exists, err := c.exists(bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errS3Exists
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	//Servers that support it refuse the upload if the key was taken since
+	header := http.Header{"If-None-Match": {"*"}}
+	resp, err := c.do("PUT", bucket, key, nil, header, file, info.Size(), payloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errS3Exists
+	default:
+		return s3Error(resp, "upload of "+key)
+	}
+}
+
+// put uploads data to key in bucket.
+func (c *s3Client) put(bucket string, key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	resp, err := c.do("PUT", bucket, key, nil, nil, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, "upload of "+key)
+	}
+	return nil
+}
+
+// exists reports whether there's an object at key in bucket.
+func (c *s3Client) exists(bucket string, key string) (bool, error) {
+	resp, err := c.do("HEAD", bucket, key, nil, nil, nil, 0, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, s3Error(resp, "check of "+key)
+	}
+}
+
+// list returns the keys in bucket starting with prefix, in order.
+func (c *s3Client) list(bucket string, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := c.do("GET", bucket, "", query, nil, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp, "listing of "+bucket)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad listing of %s: %v", bucket, err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// remove deletes the object at key in bucket.
+func (c *s3Client) remove(bucket string, key string) error {
+	resp, err := c.do("DELETE", bucket, key, nil, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, "deletion of "+key)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Names used when exposing the manager.
+const (
+	serviceName    = "wr-manager"
+	webServiceName = "wr-web"
+	tlsSecretName  = "wr-tls"
+	tlsMountPath   = "/wr-tls"
+)
+
+// serviceOpts configures the Service in front of the manager.
+type serviceOpts struct {
+	Type string
+	// TLSSecret is namespace/name of a kubernetes.io/tls Secret holding the
+	// certificate the manager should serve its web interface with.
+	TLSSecret string
+	Timeout   time.Duration
+}
+
+// addFlags registers the service options on the given command.
+func (s *serviceOpts) addFlags(c *cobra.Command) {
+	c.Flags().StringVar(&s.Type, "service-type", string(apiv1.ServiceTypeClusterIP), "How to expose the manager: ClusterIP, NodePort or LoadBalancer")
+	c.Flags().StringVar(&s.TLSSecret, "tls-secret", "", "namespace/name of a TLS Secret for the web interface (defaults to the default namespace)")
+	c.Flags().DurationVar(&s.Timeout, "service-timeout", 5*time.Minute, "How long to wait for a NodePort or LoadBalancer address")
+}
+
+// validate checks the options make sense.
+func (s *serviceOpts) validate() error {
+	switch apiv1.ServiceType(s.Type) {
+	case apiv1.ServiceTypeClusterIP, apiv1.ServiceTypeNodePort, apiv1.ServiceTypeLoadBalancer:
+	default:
+		return fmt.Errorf("unsupported service type %q, must be ClusterIP, NodePort or LoadBalancer", s.Type)
+	}
+	return nil
+}
+
+// external reports whether the manager will be reachable from outside the
+// cluster.
+func (s *serviceOpts) external() bool {
+	return apiv1.ServiceType(s.Type) != apiv1.ServiceTypeClusterIP
+}
+
+// scheme returns the URL scheme the web interface will be served with.
+func (s *serviceOpts) scheme() string {
+	if s.TLSSecret != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// managerService returns a ClusterIP Service exposing the manager and web
+// ports of the manager pod within the cluster.
+func managerService() *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   serviceName,
+			Labels: managerLabels,
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:     apiv1.ServiceTypeClusterIP,
+			Selector: managerLabels,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "wr-manager",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       managerPort,
+					TargetPort: intstr.FromString("wr-manager"),
+				},
+				{
+					Name:       "wr-web",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       webPort,
+					TargetPort: intstr.FromString("wr-web"),
+				},
+			},
+		},
+	}
+}
+
+// webService returns a Service of the given type exposing only the web port
+// of the manager pod, so the manager port is never reachable from outside the
+// cluster.
+func webService(serviceType apiv1.ServiceType) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   webServiceName,
+			Labels: managerLabels,
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:     serviceType,
+			Selector: managerLabels,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "wr-web",
+					Protocol:   apiv1.ProtocolTCP,
+					Port:       webPort,
+					TargetPort: intstr.FromString("wr-web"),
+				},
+			},
+		},
+	}
+}
+
+// copyTLSSecret copies the user's TLS Secret in to the deployment's namespace,
+// since pods can only mount Secrets from their own namespace.
+func copyTLSSecret(clientset kubernetes.Interface, from string, namespace string) error {
+	fromNamespace, fromName := apiv1.NamespaceDefault, from
+	if i := strings.Index(from, "/"); i >= 0 {
+		fromNamespace, fromName = from[:i], from[i+1:]
+	}
+	secret, err := clientset.CoreV1().Secrets(fromNamespace).Get(fromName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get TLS secret %s/%s: %v", fromNamespace, fromName, err)
+	}
+	for _, key := range []string{apiv1.TLSCertKey, apiv1.TLSPrivateKeyKey} {
+		if _, ok := secret.Data[key]; !ok {
+			return fmt.Errorf("TLS secret %s/%s has no %s", fromNamespace, fromName, key)
+		}
+	}
+	_, err = clientset.CoreV1().Secrets(namespace).Create(&apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: tlsSecretName,
+		},
+		Type: apiv1.SecretTypeTLS,
+		Data: map[string][]byte{
+			apiv1.TLSCertKey:       secret.Data[apiv1.TLSCertKey],
+			apiv1.TLSPrivateKeyKey: secret.Data[apiv1.TLSPrivateKeyKey],
+		},
+	})
+	return err
+}
+
+// addTLS mounts the copied TLS Secret in to the manager container, and points
+// wr at it through its environment variable config.
+func addTLS(podSpec *apiv1.PodSpec) {
+	podSpec.Volumes = append(podSpec.Volumes, apiv1.Volume{
+		Name: tlsSecretName,
+		VolumeSource: apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{
+				SecretName: tlsSecretName,
+			},
+		},
+	})
+	container := &podSpec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+		Name:      tlsSecretName,
+		MountPath: tlsMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		apiv1.EnvVar{Name: "WR_MANAGERCERTFILE", Value: tlsMountPath + "/" + apiv1.TLSCertKey},
+		apiv1.EnvVar{Name: "WR_MANAGERKEYFILE", Value: tlsMountPath + "/" + apiv1.TLSPrivateKeyKey},
+	)
+}
+
+// exposeManager creates the manager's Service in the given namespace, and
+// the web interface's if it is to be reachable from outside the cluster.
+func exposeManager(clientset kubernetes.Interface, namespace string, s *serviceOpts) error {
+	services := []*apiv1.Service{managerService()}
+	if s.external() {
+		services = append(services, webService(apiv1.ServiceType(s.Type)))
+	}
+	for _, svc := range services {
+		if _, err := clientset.CoreV1().Services(namespace).Create(svc); err != nil {
+			return fmt.Errorf("failed to create service %s: %v", svc.ObjectMeta.Name, err)
+		}
+	}
+	return nil
+}
+
+// managerURL waits for the web interface's Service to be given an address and
+// returns the URL of the web interface.
+func managerURL(clientset kubernetes.Interface, namespace string, s *serviceOpts) (string, error) {
+	if !s.external() {
+		host := fmt.Sprintf("%s.%s.svc", serviceName, namespace)
+		return fmt.Sprintf("%s://%s", s.scheme(), net.JoinHostPort(host, strconv.Itoa(int(webPort)))), nil
+	}
+	var host string
+	port := webPort
+	err := wait.PollImmediate(2*time.Second, s.Timeout, func() (bool, error) {
+		svc, err := clientset.CoreV1().Services(namespace).Get(webServiceName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch svc.Spec.Type {
+		case apiv1.ServiceTypeLoadBalancer:
+			for _, ingress := range svc.Status.LoadBalancer.Ingress {
+				host = ingress.IP
+				if host == "" {
+					host = ingress.Hostname
+				}
+				if host != "" {
+					return true, nil
+				}
+			}
+			return false, nil
+		default:
+			port = servicePort(svc, "wr-web").NodePort
+			if port == 0 {
+				return false, nil
+			}
+			host, err = nodeAddress(clientset)
+			return host != "", err
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("service %s did not get an address: %v", webServiceName, err)
+	}
+	return fmt.Sprintf("%s://%s", s.scheme(), net.JoinHostPort(host, strconv.Itoa(int(port)))), nil
+}
+
+// servicePort returns the named port of a Service.
+func servicePort(svc *apiv1.Service, name string) apiv1.ServicePort {
+	for _, port := range svc.Spec.Ports {
+		if port.Name == name {
+			return port
+		}
+	}
+	return apiv1.ServicePort{}
+}
+
+// nodeAddress returns an address a NodePort can be reached on, preferring
+// external addresses over internal ones.
+func nodeAddress(clientset kubernetes.Interface) (string, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %v", err)
+	}
+	for _, addressType := range []apiv1.NodeAddressType{apiv1.NodeExternalIP, apiv1.NodeInternalIP} {
+		for _, node := range nodes.Items {
+			for _, address := range node.Status.Addresses {
+				if address.Type == addressType {
+					return address.Address, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
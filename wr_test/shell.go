@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/theobarberbany/learning-client-go/wr_test/podexec"
+	"golang.org/x/crypto/ssh/terminal"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// shellOpts configures the shell command.
+type shellOpts struct {
+	Pod       string
+	Container string
+}
+
+func newShellCmd() *cobra.Command {
+	var opts shellOpts
+	c := &cobra.Command{
+		Use:   "shell NAMESPACE [-- COMMAND [ARGS...]]",
+		Short: "Open an interactive shell in the wr manager or a runner pod",
+		Long: `Opens an interactive session in the wr manager pod of the given namespace, or
+in the pod named by --pod. The command defaults to runnerexecshell from the wr
+config (bash). If stdin is a terminal it is put in raw mode for the duration
+of the session, and changes to its size are passed on to the pod.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			command := args[1:]
+			if len(command) == 0 {
+				wrConf, err := loadWrConfig(wrConfigPath)
+				if err != nil {
+					return err
+				}
+				command = []string{wrConf.RunnerExecShell}
+			}
+			return shell(config, clientset, args[0], &opts, command)
+		},
+	}
+	c.Flags().StringVarP(&opts.Pod, "pod", "p", "", "Pod to open the shell in (defaults to the wr manager)")
+	c.Flags().StringVarP(&opts.Container, "container", "c", "", "Container to open the shell in (defaults to the pod's first container)")
+	return c
+}
+
+// shell runs an interactive command in a pod, wired up to our own stdin,
+// stdout and stderr.
+func shell(config *rest.Config, clientset kubernetes.Interface, namespace string, opts *shellOpts, command []string) error {
+	pod, err := targetPod(clientset, namespace, opts.Pod)
+	if err != nil {
+		return err
+	}
+	container := opts.Container
+	if container == "" {
+		container = pod.Spec.Containers[0].Name
+	}
+
+	stdinFd := int(os.Stdin.Fd())
+	tty := terminal.IsTerminal(stdinFd)
+	var sizeQueue remotecommand.TerminalSizeQueue
+	if tty {
+		state, err := terminal.MakeRaw(stdinFd)
+		if err != nil {
+			return fmt.Errorf("failed to put terminal in raw mode: %v", err)
+		}
+		defer terminal.Restore(stdinFd, state)
+		resizes := newTerminalSizes(func() (int, int, error) { return terminal.GetSize(stdinFd) })
+		defer resizes.stop()
+		sizeQueue = resizes
+	}
+
+	execRequest := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod.ObjectMeta.Name).
+		Namespace(pod.ObjectMeta.Namespace).
+		SubResource("exec")
+	execRequest.VersionedParams(shellExecOptions(container, command, tty), scheme.ParameterCodec)
+	exec, err := podexec.NewExecutor(config, execRequest.URL(), execTransport)
+	if err != nil {
+		return err
+	}
+	var stderr io.Writer
+	if !tty {
+		stderr = os.Stderr
+	}
+	return exec.Stream(remotecommand.StreamOptions{
+		Stdin:             os.Stdin,
+		Stdout:            os.Stdout,
+		Stderr:            stderr,
+		Tty:               tty,
+		TerminalSizeQueue: sizeQueue,
+	})
+}
+
+// shellExecOptions are the options of the exec request for an interactive
+// command in the container, with a tty or not.
+func shellExecOptions(container string, command []string, tty bool) *apiv1.PodExecOptions {
+	return &apiv1.PodExecOptions{
+		Container: container,
+		Command:   command,
+		Stdin:     true,
+		Stdout:    true,
+		//With a tty stderr is merged in to stdout
+		Stderr: !tty,
+		TTY:    tty,
+	}
+}
+
+// terminalSizes is a remotecommand.TerminalSizeQueue of the sizes of a local
+// terminal. It starts with the current size, followed by a new size every time
+// the terminal is resized.
+type terminalSizes struct {
+	// getSize returns the terminal's current size.
+	getSize func() (width int, height int, err error)
+	sizes   chan remotecommand.TerminalSize
+	done    chan struct{}
+}
+
+// newTerminalSizes starts watching the size of the terminal getSize returns
+// the size of.
+func newTerminalSizes(getSize func() (width int, height int, err error)) *terminalSizes {
+	t := &terminalSizes{
+		getSize: getSize,
+		sizes:   make(chan remotecommand.TerminalSize, 1),
+		done:    make(chan struct{}),
+	}
+	t.send()
+	go watchResizes(t.send, t.done)
+	return t
+}
+
+// send queues the terminal's current size, replacing any size that hasn't
+// been picked up yet.
+func (t *terminalSizes) send() {
+	width, height, err := t.getSize()
+	if err != nil {
+		return
+	}
+	size := remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}
+	select {
+	case <-t.sizes:
+	default:
+	}
+	select {
+	case t.sizes <- size:
+	case <-t.done:
+	}
+}
+
+// Next returns the next size of the terminal, or nil once stopped.
+func (t *terminalSizes) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-t.sizes:
+		return &size
+	case <-t.done:
+		return nil
+	}
+}
+
+// stop ends the watching of the terminal's size.
+func (t *terminalSizes) stop() {
+	close(t.done)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func newStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status NAMESPACE",
+		Short: "Report on a wr deployment and its resource usage",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, clientset, err := authenticate()
+			if err != nil {
+				return err
+			}
+			return printStatus(clientset, args[0], os.Stdout)
+		},
+	}
+}
+
+// printStatus writes a report on the wr deployment in the given namespace.
+func printStatus(clientset kubernetes.Interface, namespace string, out io.Writer) error {
+	ns, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Namespace: %s\n", ns.ObjectMeta.Name)
+	fmt.Fprintf(out, "Owner:     %s\n", ns.ObjectMeta.Labels[ownerLabel])
+	if expiry, ok := namespaceExpiry(ns); ok {
+		fmt.Fprintf(out, "Expires:   %s\n", expiry.Local().Format(time.RFC1123))
+	} else {
+		fmt.Fprintln(out, "Expires:   never")
+	}
+	if last, err := time.Parse(time.RFC3339, ns.ObjectMeta.Annotations[lastBackupAnnotation]); err == nil {
+		fmt.Fprintf(out, "Backup:    %s ago (%s)\n", time.Since(last).Round(time.Second), last.Local().Format(time.RFC1123))
+	} else {
+		fmt.Fprintln(out, "Backup:    none")
+	}
+	running, err := managerRunning(clientset, namespace)
+	if err != nil {
+		return err
+	}
+	if running {
+		fmt.Fprintln(out, "Manager:   running")
+	} else {
+		fmt.Fprintln(out, "Manager:   not running")
+	}
+	fmt.Fprintln(out)
+	return printQuotaUsage(clientset, namespace, out)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// How the tar stream sent to a pod is compressed.
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// copiedMarker is created in the destination directory once every file sent
+// to a pod is in place. The init container waits for it before exiting.
+const copiedMarker = ".wr-copied"
+
+// transferOpts configures how files are streamed in to a pod.
+type transferOpts struct {
+	Compression string
+	// Retries is how many more times a failed copy is started again from
+	// scratch.
+	Retries  int
+	Progress bool
+}
+
+// addFlags registers the transfer options on the given command.
+func (t *transferOpts) addFlags(c *cobra.Command) {
+	c.Flags().StringVar(&t.Compression, "compress", compressGzip, "Compression of files sent to the pod: none, gzip or zstd (needs zstd here and in the pod)")
+	c.Flags().IntVar(&t.Retries, "copy-retries", 3, "Times to retry sending files to the pod if the stream fails")
+	c.Flags().BoolVar(&t.Progress, "progress", true, "Report progress while sending files to the pod")
+}
+
+// validate checks the options make sense.
+func (t *transferOpts) validate() error {
+	switch t.Compression {
+	case compressNone, compressGzip:
+	case compressZstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return fmt.Errorf("--compress=zstd needs the zstd command: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown compression %q, must be none, gzip or zstd", t.Compression)
+	}
+	if t.Retries < 0 {
+		return fmt.Errorf("--copy-retries can't be negative")
+	}
+	return nil
+}
+
+// transferProgress is called as a transfer goes with the number of bytes of
+// the compressed stream sent so far, its total size, and the time taken.
+type transferProgress func(sent int64, total int64, elapsed time.Duration)
+
+// printTransferProgress returns a transferProgress that writes the amount
+// sent, throughput and estimated time left to out, at most once a second.
+func printTransferProgress(out io.Writer) transferProgress {
+	var last time.Time
+	return func(sent int64, total int64, elapsed time.Duration) {
+		if sent < total && time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		const mb = 1024 * 1024
+		rate := float64(sent) / elapsed.Seconds()
+		eta := "?"
+		if rate > 0 {
+			eta = time.Duration(float64(total-sent) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+		fmt.Fprintf(out, "\rsent %.1f/%.1f MB, %.2f MB/s, %s left   ", float64(sent)/mb, float64(total)/mb, rate/mb, eta)
+		if sent >= total {
+			fmt.Fprintln(out)
+		}
+	}
+}
+
+// progressWriter counts the bytes written through it, telling progress.
+type progressWriter struct {
+	w        io.Writer
+	sent     int64
+	total    int64
+	start    time.Time
+	progress transferProgress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.sent += int64(n)
+	if p.progress != nil {
+		p.progress(p.sent, p.total, time.Since(p.start))
+	}
+	return n, err
+}
+
+// payload is the compressed tar stream of the files being sent, built once
+// in a temp file so that every pod and every attempt can be sent it without
+// compressing the files again. The WebSocket transport can't signal the end of the input,
+// so the command in the pod is told its size.
+type payload struct {
+	file *os.File
+	size int64
+}
+
+// newPayload compresses a tarball of the given files, a map of name to local
+// path, according to compression. It must be closed to remove the temp file.
+func newPayload(files map[string]string, compression string) (*payload, error) {
+	file, err := ioutil.TempFile("", "wr_test_payload")
+	if err != nil {
+		return nil, err
+	}
+	p := &payload{file: file}
+	counter := &countingWriter{}
+	compressed, err := compressWriter(io.MultiWriter(file, counter), compression)
+	if err == nil {
+		err = makeTar(files, "", compressed)
+		if closeErr := compressed.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.size = counter.n
+	return p, nil
+}
+
+// reader returns a reader of the whole payload, independent of any other.
+func (p *payload) reader() io.Reader {
+	return io.NewSectionReader(p.file, 0, p.size)
+}
+
+// Close removes the payload's temp file.
+func (p *payload) Close() error {
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
+
+// compressWriter returns a writer compressing in to w according to
+// compression. It must be closed to flush the compressed stream.
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case compressGzip:
+		return gzip.NewWriter(w), nil
+	case compressZstd:
+		return newCommandWriter(w, "zstd", "-q", "-c")
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// commandWriter filters what's written to it through a local command.
+type commandWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func newCommandWriter(w io.Writer, name string, args ...string) (*commandWriter, error) {
+	c := &commandWriter{cmd: exec.Command(name, args...)}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = &c.stderr
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.WriteCloser = stdin
+	return c, c.cmd.Start()
+}
+
+// Close ends the command's input and waits for it to finish.
+func (c *commandWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", c.cmd.Path, err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// moveStaged returns the shell command that renames everything unpacked in
+// to $staging, dotfiles included, in to the current directory. rename can't
+// replace a directory in the way of a file: with replaceDirs the directory is
+// removed first, otherwise nothing is moved and the command fails.
+func moveStaged(replaceDirs bool) string {
+	const forEach = `find "$staging" -mindepth 1 -maxdepth 1 -exec sh -c 'for f; do t=${f##*/}; %s; done' sh {} +`
+	const inTheWay = `[ -d "$t" ] && [ ! -L "$t" ]`
+	move := fmt.Sprintf(forEach, `mv -f "$f" . || exit 1`)
+	if replaceDirs {
+		return fmt.Sprintf(forEach, `if `+inTheWay+`; then rm -rf "$t"; fi; mv -f "$f" . || exit 1`)
+	}
+	check := fmt.Sprintf(forEach, `if `+inTheWay+`; then echo "refusing to replace directory $t" >&2; exit 1; fi`)
+	return check + "\n" + move
+}
+
+// tarExtractArgs are the arguments to tar to unpack a stream on stdin
+// compressed according to compression.
+func tarExtractArgs(compression string) string {
+	switch compression {
+	case compressGzip:
+		return "-xzf -"
+	case compressZstd:
+		return "-xf - --use-compress-program=zstd"
+	default:
+		return "-xf -"
+	}
+}
+
+// extractCommand returns the command run in the init container to receive
+// the files. They are unpacked in to a fresh staging directory within
+// destDir, and only renamed in to place, and the copiedMarker created, once
+// the whole stream has been read; anything left by an earlier, failed attempt
+// is removed first. destDir is the pod's own, so a directory in the way of a
+// file is removed.
+//
+// Only size bytes are read from stdin, as with the WebSocket transport the
+// end of the input can't be signalled.
+func extractCommand(destDir string, compression string, size int64) []string {
+	script := fmt.Sprintf(`set -e
+cd %s
+rm -rf .staging.*
+staging=$(mktemp -d .staging.XXXXXX)
+head -c %d | tar %s -C "$staging"
+%s
+rmdir "$staging"
+touch %s`, shellQuote(destDir), size, tarExtractArgs(compression), moveStaged(true), copiedMarker)
+	return []string{"/bin/sh", "-c", script}
+}
+
+// copyToCommand returns the command run in a pod by copy-to to receive the
+// files. Like extractCommand they are unpacked in to a staging directory and
+// then renamed in to place, but destDir may be shared with other copies, so
+// the staging directory is only ever this copy's own, removed when it exits,
+// and there's no marker. A directory in the way of a file is only removed with
+// replaceDirs.
+func copyToCommand(destDir string, compression string, size int64, replaceDirs bool) []string {
+	script := fmt.Sprintf(`set -e
+cd %s
+staging=$(mktemp -d .wr-copy-to.XXXXXX)
+trap 'rm -rf "$staging"' EXIT
+trap 'exit 1' HUP INT TERM PIPE
+head -c %d | tar %s -C "$staging"
+%s`, shellQuote(destDir), size, tarExtractArgs(compression), moveStaged(replaceDirs))
+	return []string{"/bin/sh", "-c", script}
+}
+
+// extractFunc returns the command run in a pod to receive a tar stream of
+// size bytes, compressed according to compression.
+type extractFunc func(compression string, size int64) []string
+
+// sendFiles streams the payload, compressed according to opts, to a container
+// of the pod, where it is unpacked by the command extract returns. If the
+// stream fails the copy is started again from scratch, up to opts.Retries
+// times. It returns the number of attempts made.
+func sendFiles(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, container string, p *payload, extract extractFunc, opts *transferOpts, progress transferProgress) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := sendFilesOnce(config, clientset, pod, container, p, extract, opts.Compression, progress)
+		if err == nil {
+			return attempt, nil
+		}
+		//The stream may have broken after the files were put in place and the
+		//init container exited, in which case there's nothing to retry.
+		if done, doneErr := initContainerDone(clientset, pod, container); doneErr == nil && done {
+			return attempt, nil
+		}
+		if attempt > opts.Retries {
+			return attempt, err
+		}
+		wait := time.Duration(attempt) * 5 * time.Second
+		fmt.Fprintf(os.Stderr, "\nCopy to pod %s failed: %v; retrying in %s\n", pod.ObjectMeta.Name, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// sendFilesOnce makes a single attempt at sendFiles.
+func sendFilesOnce(config *rest.Config, clientset kubernetes.Interface, pod *apiv1.Pod, container string, p *payload, extract extractFunc, compression string, progress transferProgress) error {
+	counter := &progressWriter{w: ioutil.Discard, total: p.size, start: time.Now(), progress: progress}
+	var stderr bytes.Buffer
+	err := execWithStdin(config, clientset, pod, container, extract(compression, p.size), io.TeeReader(p.reader(), counter), nil, &stderr)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// initContainerDone reports whether the named init container of the pod has
+// exited successfully.
+func initContainerDone(clientset kubernetes.Interface, pod *apiv1.Pod, container string) (bool, error) {
+	current, err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Get(pod.ObjectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, status := range current.Status.InitContainerStatuses {
+		if status.Name == container && status.State.Terminated != nil {
+			return status.State.Terminated.ExitCode == 0, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForCopyCommand returns the command an init container runs to wait for
+// files to be sent in to destDir by sendFiles.
+func waitForCopyCommand(destDir string) []string {
+	return []string{"/bin/sh", "-c", fmt.Sprintf("until [ -e %s ]; do sleep 1; done", shellQuote(path.Join(destDir, copiedMarker)))}
+}
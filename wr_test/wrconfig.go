@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// wrConfig holds the settings from a wr config file (see wr_config.yml) that
+// the deployer needs to know about.
+type wrConfig struct {
+	ManagerPort     string `yaml:"managerport"`
+	ManagerWeb      string `yaml:"managerweb"`
+	ManagerDir      string `yaml:"managerdir"`
+	ManagerLogFile  string `yaml:"managerlogfile"`
+	ManagerDbFile   string `yaml:"managerdbfile"`
+	ManagerDbBkFile string `yaml:"managerdbbkfile"`
+	RunnerExecShell string `yaml:"runnerexecshell"`
+	CloudRAM        int    `yaml:"cloudram"`
+	CloudDisk       int    `yaml:"clouddisk"`
+}
+
+// defaultWrConfig returns wr's own defaults for the settings we use.
+func defaultWrConfig() *wrConfig {
+	return &wrConfig{
+		ManagerDir:      "~/.wr",
+		ManagerLogFile:  "log",
+		ManagerDbFile:   "db",
+		ManagerDbBkFile: "db_bk",
+		RunnerExecShell: "bash",
+		CloudRAM:        2048,
+		CloudDisk:       1,
+	}
+}
+
+// loadWrConfig reads the wr config file at the given path on top of wr's
+// defaults. A missing file is not an error; you just get the defaults.
+func loadWrConfig(path string) (*wrConfig, error) {
+	config := defaultWrConfig()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// containerHome is the home directory of the user wr runs as in its pods.
+const containerHome = "/root"
+
+// managerFile returns where inside the manager container wr keeps the given
+// file setting (eg. ManagerLogFile). Relative paths are relative to
+// managerdir, which wr suffixes with the deployment name; we always run
+// production deployments.
+func (c *wrConfig) managerFile(file string) string {
+	if path.IsAbs(file) {
+		return file
+	}
+	dir := c.ManagerDir
+	if strings.HasPrefix(dir, "~") {
+		dir = containerHome + dir[1:]
+	}
+	return path.Join(dir+"_production", file)
+}